@@ -12,7 +12,8 @@ func main() {
 	mainConfig := config.New()
 	logger.Init(mainConfig)
 	tools := command.New(mainConfig)
-	if err := tools.App.Run(os.Args); err != nil {
+	if err := tools.Run(os.Args); err != nil {
 		log.Printf("%+v", err)
+		os.Exit(1)
 	}
 }
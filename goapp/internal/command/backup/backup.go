@@ -3,7 +3,11 @@ package backup
 import (
 	"clickhouse-tools/internal/helper"
 	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/remote"
 	"clickhouse-tools/pkg/archiver"
+	"clickhouse-tools/pkg/progress"
+	"encoding/json"
 	"fmt"
 	archiverLibrary "github.com/mholt/archiver/v3"
 	log "github.com/sirupsen/logrus"
@@ -28,22 +32,34 @@ type Tool struct {
 	clickhouse *clickhouse.Client
 	command    *cli.Command
 	archiver   *archiver.Archiver
+	agent      *remote.Agent
 	paths      *Paths
 	name       string
+	tables     int
+}
+
+// Result describes the created backup in the json output.
+type Result struct {
+	BackupName string `json:"backup_name"`
+	Database   string `json:"database"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Tables     int    `json:"tables"`
 }
 
 type Paths struct {
 	base, shadow, archive string
 }
 
-func New(cliApp *cli.App, clickhouseClient *clickhouse.Client, archiver *archiver.Archiver) *Tool {
+func New(cliApp *cli.App, clickhouseClient *clickhouse.Client, archiver *archiver.Archiver, agent *remote.Agent) *Tool {
 	return &Tool{
 		clickhouse: clickhouseClient,
 		archiver:   archiver,
+		agent:      agent,
 		command: &cli.Command{
 			Name:        "backup",
 			Usage:       "Create new backup",
-			UsageText:   "clickhouse-tools backup [-db, --database=<database>]",
+			UsageText:   "clickhouse-tools backup [-db, --database=<database>] [--cluster=<cluster>]",
 			Description: "Create new backup",
 			Flags: append(cliApp.Flags,
 				&cli.StringFlag{
@@ -52,6 +68,22 @@ func New(cliApp *cli.App, clickhouseClient *clickhouse.Client, archiver *archive
 					Hidden:   false,
 					Required: true,
 				},
+				&cli.StringFlag{
+					Name:  "cluster",
+					Usage: "Back up every shard of the cluster from one of its replicas",
+				},
+				// shadow and name are passed by a cluster backup running the
+				// backup of a shard on its replica.
+				&cli.StringFlag{
+					Name:   "shadow",
+					Usage:  "Archive the tables frozen with the name instead of freezing them",
+					Hidden: true,
+				},
+				&cli.StringFlag{
+					Name:   "name",
+					Usage:  "Name of the archive without the extension",
+					Hidden: true,
+				},
 			),
 		},
 		paths: &Paths{
@@ -63,12 +95,26 @@ func New(cliApp *cli.App, clickhouseClient *clickhouse.Client, archiver *archive
 
 func (tool *Tool) GetCommand() *cli.Command {
 	tool.command.Action = func(c *cli.Context) error {
-		return tool.Backup(c.String("database"))
+		if c.String("cluster") != "" {
+			return tool.backupCluster(c.String("database"), c.String("cluster"))
+		}
+		if err := tool.backup(c.String("database"), c.String("shadow"), c.String("name")); err != nil {
+			return err
+		}
+		output.SetResult(tool.Result(c.String("database")))
+		return nil
 	}
 	return tool.command
 }
 
 func (tool *Tool) Backup(database string) error {
+	return tool.backup(database, "", "")
+}
+
+// backup archives the database as <name>.<extension>, <database>_<timestamp>
+// by default. With a shadow name the tables already frozen with that name are
+// archived instead of freezing them.
+func (tool *Tool) backup(database, shadowName, name string) error {
 	fmt.Println("Starting backup!")
 	if err := tool.createPaths(); err != nil {
 		return err
@@ -77,7 +123,10 @@ func (tool *Tool) Backup(database string) error {
 		return err
 	}
 	defer tool.clickhouse.CloseConnection()
-	tool.name = fmt.Sprintf("%s_%s", database, time.Now().UTC().Format(TimeFormat))
+	if name == "" {
+		name = fmt.Sprintf("%s_%s", database, time.Now().UTC().Format(TimeFormat))
+	}
+	tool.name = name
 	tool.paths.archive = strings.Join([]string{path.Join(tool.paths.base, tool.name), tool.archiver.GetExtension()}, ".")
 	writer, err := tool.archiver.Create(tool.paths.archive)
 	if err != nil {
@@ -93,13 +142,19 @@ func (tool *Tool) Backup(database string) error {
 	if err != nil {
 		return err
 	}
-	if err := tool.clickhouse.Freeze(database, tables); err != nil {
-		return err
+	tool.tables = len(tables)
+	if shadowName == "" {
+		if err := tool.clickhouse.Freeze(database, tables); err != nil {
+			return err
+		}
 	}
 	if err := tool.backupMetadata(writer, tables); err != nil {
 		return err
 	}
-	if err := tool.backupShadow(writer); err != nil {
+	if err := tool.backupShadow(writer, database, tables, shadowName); err != nil {
+		return err
+	}
+	if err := tool.backupKeeper(writer, database); err != nil {
 		return err
 	}
 	fmt.Printf("Successful finish backup '%s'!\n", tool.paths.archive)
@@ -171,13 +226,27 @@ func (tool *Tool) backupMetadata(writer archiverLibrary.Writer, tables []clickho
 	return nil
 }
 
-func (tool *Tool) backupShadow(writer archiverLibrary.Writer) error {
-	increment, err := helper.ReadFile(path.Join(clickhouse.DefaultDataPath, shadow, incrementFile))
+func (tool *Tool) backupShadow(writer archiverLibrary.Writer, database string, tables []clickhouse.Table, shadowName string) error {
+	if shadowName == "" {
+		increment, err := helper.ReadFile(path.Join(clickhouse.DefaultDataPath, shadow, incrementFile))
+		if err != nil {
+			return err
+		}
+		shadowName = increment
+	}
+	shadowPath := path.Join(clickhouse.DefaultDataPath, shadow, shadowName, "store")
+	if err := tool.backupManifest(writer, database, shadowPath, tables); err != nil {
+		return err
+	}
+	fmt.Print("Archive tables data...")
+	size, files, err := measure(shadowPath)
 	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
-	shadowPath := path.Join(clickhouse.DefaultDataPath, shadow, increment, "store")
-	if err := filepath.Walk(shadowPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+	archiveProgress := progress.Start("archive", size)
+	archiveProgress.SetItems(files, progress.UnitFiles)
+	err = filepath.Walk(shadowPath, func(filePath string, fileInfo os.FileInfo, err error) error {
 		if err != nil {
 			log.Errorf("%+v", err)
 			return err
@@ -192,18 +261,23 @@ func (tool *Tool) backupShadow(writer archiverLibrary.Writer) error {
 		if err := tool.archiver.AddFile(
 			writer,
 			&archiver.File{
-				Path: filePath,
-				Name: filename,
-				Info: fileInfo,
+				Path:     filePath,
+				Name:     filename,
+				Info:     fileInfo,
+				Progress: archiveProgress,
 			},
 		); err != nil {
 			log.Errorf("%+v", err)
 			return err
 		}
 		return nil
-	}); err != nil {
+	})
+	archiveProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
 	if err = os.RemoveAll(path.Join(clickhouse.DefaultDataPath, shadow)); err != nil {
 		log.Errorf("%+v", err)
 		return err
@@ -211,6 +285,93 @@ func (tool *Tool) backupShadow(writer archiverLibrary.Writer) error {
 	return nil
 }
 
+// backupManifest adds the manifest of the frozen parts, checked by restore.
+func (tool *Tool) backupManifest(writer archiverLibrary.Writer, database, shadowPath string, tables []clickhouse.Table) error {
+	manifest, err := clickhouse.NewManifest(database, shadowPath, tables)
+	if err != nil {
+		return err
+	}
+	return tool.addJSON(writer, clickhouse.ManifestFile, manifest)
+}
+
+// backupKeeper adds the Keeper metadata of the replicated tables, if any. The
+// data is restored without it, so failing to read it only warns.
+func (tool *Tool) backupKeeper(writer archiverLibrary.Writer, database string) error {
+	keeper, err := tool.clickhouse.NewKeeperBackup(database)
+	if err != nil {
+		log.Warnf("keeper metadata of '%s' is not backed up: %v", database, err)
+		return nil
+	}
+	if keeper == nil {
+		return nil
+	}
+	return tool.addJSON(writer, clickhouse.KeeperFile, keeper)
+}
+
+// addJSON adds the value as the json file name to the root of the archive.
+func (tool *Tool) addJSON(writer archiverLibrary.Writer, name string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	tmpFile := path.Join("/tmp", name)
+	if err := helper.CreateFile(tmpFile, string(content)); err != nil {
+		return err
+	}
+	if err := tool.archiver.AddFile(
+		writer,
+		&archiver.File{
+			Path: tmpFile,
+			Name: name,
+			Info: nil,
+		},
+	); err != nil {
+		return err
+	}
+	if err := os.Remove(tmpFile); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+// measure sums the size and the number of regular files under the path.
+func measure(root string) (int64, int, error) {
+	var (
+		size  int64
+		files int
+	)
+	if err := filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			size += fileInfo.Size()
+			files++
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	return size, files, nil
+}
+
+// Result describes the last backup created by Backup.
+func (tool *Tool) Result(database string) *Result {
+	result := &Result{
+		BackupName: tool.GetArchiveName(),
+		Database:   database,
+		Path:       tool.paths.archive,
+		Tables:     tool.tables,
+	}
+	if fileStat, err := os.Stat(tool.paths.archive); err == nil {
+		result.Size = fileStat.Size()
+	}
+	return result
+}
+
 func (tool *Tool) GetArchiveName() string {
 	return strings.Join([]string{path.Join(tool.name), tool.archiver.GetExtension()}, ".")
 }
@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/output"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ClusterResult describes the cluster backup in the json output.
+type ClusterResult struct {
+	BackupName string                    `json:"backup_name"`
+	Cluster    string                    `json:"cluster"`
+	Database   string                    `json:"database"`
+	Shards     []clickhouse.ClusterShard `json:"shards"`
+}
+
+// backupCluster freezes the tables on one healthy replica of every shard
+// together, archives each shard on its replica and collects the archives
+// with a cluster manifest. Remote replicas archive their shard by running
+// the backup command over ssh and the archive is fetched from them.
+func (tool *Tool) backupCluster(database, cluster string) error {
+	fmt.Printf("Starting backup of cluster '%s'!\n", cluster)
+	if err := tool.createPaths(); err != nil {
+		return err
+	}
+	replicas, tables, err := tool.clusterReplicas(database, cluster)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%s", database, time.Now().UTC().Format(TimeFormat))
+	if err := tool.freezeReplicas(database, tables, replicas, name); err != nil {
+		return err
+	}
+	manifest := &clickhouse.ClusterManifest{
+		Cluster:   cluster,
+		Database:  database,
+		CreatedAt: time.Now().UTC(),
+	}
+	result := &ClusterResult{
+		BackupName: name + clickhouse.ClusterManifestExtension,
+		Cluster:    cluster,
+		Database:   database,
+	}
+	output.SetResult(result)
+	for _, replica := range replicas {
+		shard, err := tool.backupShard(database, name, replica)
+		if err != nil {
+			tool.unfreezeReplicas(replicas, name)
+			return err
+		}
+		manifest.Shards = append(manifest.Shards, shard)
+		result.Shards = append(result.Shards, shard)
+	}
+	if err := manifest.Save(path.Join(tool.paths.base, result.BackupName)); err != nil {
+		return err
+	}
+	fmt.Printf("Successful finish backup of cluster '%s'!\n", path.Join(tool.paths.base, result.BackupName))
+	return nil
+}
+
+func (tool *Tool) clusterReplicas(database, cluster string) ([]clickhouse.Replica, []clickhouse.Table, error) {
+	if err := tool.clickhouse.Connect(""); err != nil {
+		return nil, nil, err
+	}
+	defer tool.clickhouse.CloseConnection()
+	replicas, err := tool.clickhouse.GetReplicas(cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Print("Choose replicas...")
+	if replicas, err = tool.clickhouse.HealthyReplicas(replicas); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return nil, nil, err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	for _, replica := range replicas {
+		fmt.Printf("- shard %d: replica %d '%s'\n", replica.Shard, replica.Replica, replica.Host)
+	}
+	tables, err := tool.clickhouse.GetTables(database)
+	if err != nil {
+		return nil, nil, err
+	}
+	return replicas, tables, nil
+}
+
+// freezeReplicas freezes the tables on all the replicas at once, so the
+// shards are backed up at the same moment.
+func (tool *Tool) freezeReplicas(database string, tables []clickhouse.Table, replicas []clickhouse.Replica, name string) error {
+	fmt.Print("Freeze shards...")
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []error
+	)
+	for _, replica := range replicas {
+		wg.Add(1)
+		go func(replica clickhouse.Replica) {
+			defer wg.Done()
+			client := tool.clickhouse.ForReplica(replica)
+			err := client.Connect("")
+			if err == nil {
+				err = client.FreezeWithName(database, tables, name)
+				client.CloseConnection()
+			}
+			if err != nil {
+				mu.Lock()
+				failures = append(failures, err)
+				mu.Unlock()
+			}
+		}(replica)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		tool.unfreezeReplicas(replicas, name)
+		return failures[0]
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// unfreezeReplicas removes the frozen data of a failed cluster backup.
+func (tool *Tool) unfreezeReplicas(replicas []clickhouse.Replica, name string) {
+	for _, replica := range replicas {
+		client := tool.clickhouse.ForReplica(replica)
+		if err := client.Connect(""); err != nil {
+			continue
+		}
+		if _, err := client.Connection.Exec(fmt.Sprintf("SYSTEM UNFREEZE WITH NAME '%s'", name)); err != nil {
+			log.Warnf("can't unfreeze '%s' on '%s': %v", name, replica.Host, err)
+		}
+		client.CloseConnection()
+	}
+}
+
+// backupShard archives the frozen shard on its replica into the local backup
+// directory.
+func (tool *Tool) backupShard(database, name string, replica clickhouse.Replica) (clickhouse.ClusterShard, error) {
+	archiveName := fmt.Sprintf("%s_shard%d", name, replica.Shard)
+	shard := clickhouse.ClusterShard{
+		Replica: replica,
+		Backup:  archiveName + "." + tool.archiver.GetExtension(),
+	}
+	localPath := path.Join(tool.paths.base, shard.Backup)
+	if replica.IsLocal == 1 {
+		if err := tool.backup(database, name, archiveName); err != nil {
+			return shard, err
+		}
+	} else {
+		fmt.Printf("Archive shard %d on '%s'...", replica.Shard, replica.Host)
+		var result Result
+		if err := tool.agent.Run(replica.Host, &result, "backup", "-db", database, "--shadow", name, "--name", archiveName); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return shard, err
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+		fmt.Printf("Fetch shard %d from '%s'...", replica.Shard, replica.Host)
+		if err := tool.agent.Fetch(replica.Host, result.Path, localPath); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return shard, err
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+		if err := tool.agent.Remove(replica.Host, result.Path); err != nil {
+			log.Warnf("archive '%s' is left on '%s'", result.Path, replica.Host)
+		}
+	}
+	if fileStat, err := os.Stat(localPath); err == nil {
+		shard.Size = fileStat.Size()
+	}
+	return shard, nil
+}
@@ -3,10 +3,16 @@ package cluster
 import (
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
 	"fmt"
 	"github.com/urfave/cli/v2"
 )
 
+// Result lists the clusters in the json output.
+type Result struct {
+	Clusters []string `json:"clusters"`
+}
+
 type Tool struct {
 	conf       *config.Application
 	command    *cli.Command
@@ -50,6 +56,7 @@ func (tool *Tool) printClusters(database string) error {
 	if err != nil {
 		return err
 	}
+	output.SetResult(&Result{Clusters: append([]string{}, clusters...)})
 	if len(clusters) == 0 {
 		fmt.Println("no clusters found")
 		return nil
@@ -5,12 +5,20 @@ import (
 	"clickhouse-tools/internal/command/cluster"
 	"clickhouse-tools/internal/command/database"
 	"clickhouse-tools/internal/command/download"
+	"clickhouse-tools/internal/command/keeper"
 	"clickhouse-tools/internal/command/list"
+	"clickhouse-tools/internal/command/multipart"
+	"clickhouse-tools/internal/command/remove"
 	"clickhouse-tools/internal/command/restore"
+	"clickhouse-tools/internal/command/rollback"
+	"clickhouse-tools/internal/command/storages"
 	"clickhouse-tools/internal/command/task"
+	"clickhouse-tools/internal/command/transfer"
 	"clickhouse-tools/internal/command/upload"
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/remote"
 	"clickhouse-tools/pkg/archiver"
 	"github.com/urfave/cli/v2"
 )
@@ -21,11 +29,14 @@ const (
 
 type Tools struct {
 	App *cli.App
+	// command is the name of the running command.
+	command string
 }
 
 func New(conf *config.Application) *Tools {
 	Clickhouse := clickhouse.New(conf.Clickhouse)
 	Archiver := archiver.New(conf.Archiver)
+	Agent := remote.New(conf.Cluster)
 	cliApp := &cli.App{
 		Name:        "clickhouse-tools",
 		Usage:       "Tool for backup clickhouse",
@@ -34,25 +45,72 @@ func New(conf *config.Application) *Tools {
 		Version:     version,
 		Flags:       []cli.Flag{},
 	}
-	backupTool := backup.New(cliApp, Clickhouse, Archiver)
+	backupTool := backup.New(cliApp, Clickhouse, Archiver, Agent)
 	uploadTool := upload.New(cliApp, conf)
 	listTool := list.New(cliApp, conf)
 	downloadTool := download.New(cliApp, conf)
-	restoreTool := restore.New(cliApp, conf, Clickhouse, Archiver)
+	removeTool := remove.New(cliApp, conf)
+	multipartTool := multipart.New(cliApp, conf)
+	storagesTool := storages.New(cliApp, conf)
+	transferTool := transfer.New(cliApp, conf)
+	restoreTool := restore.New(cliApp, conf, Clickhouse, Archiver, backupTool, Agent)
+	rollbackTool := rollback.New(cliApp, conf, Clickhouse, restoreTool)
 	clusterTool := cluster.New(cliApp, conf, Clickhouse)
-	taskTool := task.New(cliApp, backupTool, uploadTool)
+	keeperTool := keeper.New(cliApp, conf, Clickhouse)
+	taskTool := task.New(cliApp, conf, backupTool)
 	databaseTool := database.New(cliApp, conf, Clickhouse)
 	cliApp.Commands = []*cli.Command{
 		backupTool.GetCommand(),
 		uploadTool.GetCommand(),
 		listTool.GetCommand(),
 		downloadTool.GetCommand(),
+		removeTool.GetCommand(),
+		multipartTool.GetCommand(),
+		storagesTool.GetCommand(),
+		transferTool.GetCommand(),
 		restoreTool.GetCommand(),
+		rollbackTool.GetCommand(),
 		clusterTool.GetCommand(),
+		keeperTool.GetCommand(),
 		taskTool.GetCommand(),
 		databaseTool.GetCommand(),
 	}
-	return &Tools{
+	for _, command := range cliApp.Commands {
+		command.Action = reported(command.Action)
+	}
+	// The global flags are set after the commands are built, so the commands
+	// don't copy them, they are given before the command name.
+	cliApp.Flags = globalFlags()
+	tools := &Tools{
 		App: cliApp,
 	}
+	cliApp.Before = tools.before(conf)
+	return tools
+}
+
+// Run runs the command of the arguments. A failure before the action of the
+// command, e.g. a usage error, is reported by the json document too.
+func (tools *Tools) Run(args []string) error {
+	err := tools.App.Run(args)
+	output.WriteUnreported(tools.command, err)
+	return err
+}
+
+func globalFlags() []cli.Flag {
+	flags := append(outputFlags(), throttleFlags()...)
+	return append(flags, progressFlags()...)
+}
+
+func (tools *Tools) before(conf *config.Application) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		tools.command = c.Args().First()
+		if err := applyOutput(c); err != nil {
+			return err
+		}
+		err := applyThrottle(conf)(c)
+		if err == nil {
+			err = applyProgress(conf)(c)
+		}
+		return err
+	}
 }
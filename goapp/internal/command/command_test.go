@@ -0,0 +1,131 @@
+package command
+
+import (
+	"bytes"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/remote"
+	"clickhouse-tools/internal/service/storage/azblob"
+	"clickhouse-tools/internal/service/storage/gcs"
+	"clickhouse-tools/internal/service/storage/local"
+	"clickhouse-tools/internal/service/storage/rsync"
+	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/internal/service/storage/sftp"
+	"clickhouse-tools/pkg/archiver"
+	"clickhouse-tools/pkg/encryptor"
+	"clickhouse-tools/pkg/progress"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newConfig() *config.Application {
+	return &config.Application{
+		Clickhouse: &clickhouse.Config{},
+		Rsync:      &rsync.Config{},
+		Archiver:   &archiver.Config{},
+		S3:         &s3.Config{},
+		GCS:        &gcs.Config{},
+		AzBlob:     &azblob.Config{},
+		Sftp:       &sftp.Config{},
+		Local:      &local.Config{},
+		Encryption: &encryptor.Config{},
+		Task:       &config.Task{},
+		Throttle:   &config.Throttle{},
+		Progress:   &progress.Config{Enabled: true},
+		Cluster:    &remote.Config{},
+		Storages:   map[string]*config.StorageProfile{},
+	}
+}
+
+func TestGlobalFlags(t *testing.T) {
+	stdout := os.Stdout
+	tests := []struct {
+		name    string
+		args    []string
+		success bool
+	}{
+		{
+			name:    "before the command",
+			args:    []string{"--output", "json", "--upload-limit", "1M", "--no-progress", "storages"},
+			success: true,
+		},
+		{name: "after the command", args: []string{"storages", "--output", "json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				os.Stdout = stdout
+				_ = output.Init(output.FormatText)
+			})
+			conf := newConfig()
+			err := New(conf).Run(append([]string{"clickhouse-tools"}, test.args...))
+			if (err == nil) != test.success {
+				t.Fatalf("unexpected result of the command: %v", err)
+			}
+			if !test.success {
+				return
+			}
+			if !output.IsJSON() {
+				t.Fatal("expected the json output")
+			}
+			if conf.Throttle.UploadLimit != 1<<20 {
+				t.Fatalf("expected the upload limit of 1M, got %d", conf.Throttle.UploadLimit)
+			}
+			if conf.Progress.Enabled {
+				t.Fatal("expected the progress to be disabled")
+			}
+		})
+	}
+}
+
+// TestJSONErrors runs the commands failing before their actions and in them,
+// stdout gets a single failed document in both cases.
+func TestJSONErrors(t *testing.T) {
+	stdout := os.Stdout
+	tests := []struct {
+		name    string
+		args    []string
+		command string
+	}{
+		{name: "missing required flag", args: []string{"upload", "db_2024-01-02T03-04-05.tar.lz4"}, command: "upload"},
+		{name: "unknown flag", args: []string{"storages", "--unknown"}, command: "storages"},
+		{name: "usage error", args: []string{"upload", "-s", "s3"}, command: "upload"},
+		{name: "failed global flag", args: []string{"--upload-limit", "fast", "storages"}, command: "storages"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdoutFile, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Stdout = stdoutFile
+			t.Cleanup(func() {
+				os.Stdout = stdout
+				_ = output.Init(output.FormatText)
+				_ = stdoutFile.Close()
+			})
+			args := append([]string{"clickhouse-tools", "--output", "json"}, test.args...)
+			if err := New(newConfig()).Run(args); err == nil {
+				t.Fatal("expected the command to fail")
+			}
+			content, err := os.ReadFile(stdoutFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var document output.Document
+			decoder := json.NewDecoder(bytes.NewReader(content))
+			if err := decoder.Decode(&document); err != nil {
+				t.Fatalf("stdout is not a json document: %v: %s", err, content)
+			}
+			if decoder.More() {
+				t.Fatalf("stdout has more than one document: %s", content)
+			}
+			if document.Success || document.Error == "" || document.Command != test.command {
+				t.Fatalf("unexpected document %+v", document)
+			}
+		})
+	}
+}
@@ -3,10 +3,16 @@ package database
 import (
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
 	"fmt"
 	"github.com/urfave/cli/v2"
 )
 
+// Result lists the databases in the json output.
+type Result struct {
+	Databases []string `json:"databases"`
+}
+
 type Tool struct {
 	conf       *config.Application
 	command    *cli.Command
@@ -43,6 +49,7 @@ func (tool *Tool) printDatabases() error {
 	if err != nil {
 		return err
 	}
+	output.SetResult(&Result{Databases: append([]string{}, clusters...)})
 	if len(clusters) == 0 {
 		fmt.Println("no databases found")
 		return nil
@@ -3,14 +3,25 @@ package download
 import (
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
 	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/pkg/encryptor"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"os"
 	"path"
+	"strings"
 )
 
+// Result describes the downloaded backup in the json output.
+type Result struct {
+	BackupName string `json:"backup_name"`
+	Storage    string `json:"storage"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+}
+
 type Tool struct {
 	config  *config.Application
 	command *cli.Command
@@ -22,7 +33,7 @@ func New(cliApp *cli.App, conf *config.Application) *Tool {
 		command: &cli.Command{
 			Name:        "download",
 			Usage:       "Download backup from remote storage",
-			UsageText:   "clickhouse-tools download [-s, --storage=<storage>] <backup_name>",
+			UsageText:   "clickhouse-tools download [-s, --storage=<storage>] [--resume] <backup_name>",
 			Description: "Download backup from remote storage",
 			Flags: append(cliApp.Flags,
 				&cli.StringFlag{
@@ -31,6 +42,10 @@ func New(cliApp *cli.App, conf *config.Application) *Tool {
 					Hidden:   false,
 					Required: true,
 				},
+				&cli.BoolFlag{
+					Name:  "resume",
+					Usage: "Continue an interrupted transfer",
+				},
 			),
 		},
 	}
@@ -45,17 +60,27 @@ func (tool *Tool) GetCommand() *cli.Command {
 
 func (tool *Tool) download(c *cli.Context, backupName, storageName string) error {
 	if backupName == "" {
-		log.Errorf("%+v", errors.New("backup name must be defined"))
-		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+		return output.UsageError(c, errors.New("backup name must be defined"))
 	}
 	fmt.Println("Starting download backup!")
 	storageObj, err := storage.InitStorage(tool.config, storageName)
 	if err != nil {
 		return err
 	}
-	if err := storageObj.Download(path.Join(clickhouse.DefaultDataPath, "backup", backupName), backupName); err != nil {
+	if resumable, ok := storageObj.(storage.Resumable); ok {
+		resumable.SetResume(c.Bool("resume"))
+	}
+	destination := path.Join(clickhouse.DefaultDataPath, "backup", backupName)
+	result := &Result{BackupName: backupName, Storage: storageName, Path: destination}
+	output.SetResult(result)
+	if err := storageObj.Download(destination, backupName); err != nil {
 		return err
 	}
+	// Encrypted backups are stored decrypted, without the extension.
+	result.Path = strings.TrimSuffix(destination, encryptor.Extension)
+	if fileStat, err := os.Stat(result.Path); err == nil {
+		result.Size = fileStat.Size()
+	}
 	fmt.Println("Successful finish download backup!")
 	return nil
 }
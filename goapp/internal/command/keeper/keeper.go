@@ -0,0 +1,97 @@
+package keeper
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"fmt"
+	"github.com/urfave/cli/v2"
+)
+
+// Result lists the replicas of the replicated tables in the json output,
+// with --tree also the Keeper subtrees of the tables.
+type Result struct {
+	Database string                     `json:"database"`
+	Replicas []clickhouse.KeeperReplica `json:"replicas"`
+	Tables   []clickhouse.KeeperTable   `json:"tables,omitempty"`
+}
+
+type Tool struct {
+	conf       *config.Application
+	command    *cli.Command
+	clickhouse *clickhouse.Client
+}
+
+func New(cliApp *cli.App, conf *config.Application, clickhouse *clickhouse.Client) *Tool {
+	return &Tool{
+		conf: conf,
+		command: &cli.Command{
+			Name:        "keeper",
+			Usage:       "Inspect Keeper metadata of replicated tables",
+			UsageText:   "clickhouse-tools keeper [-db, --database=<database>] [--tree]",
+			Description: "List the replicas registered in ZooKeeper or ClickHouse Keeper under the paths of the replicated tables of the database",
+			Flags: append(cliApp.Flags,
+				&cli.StringFlag{
+					Name:     "database",
+					Aliases:  []string{"db"},
+					Hidden:   false,
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "tree",
+					Usage: "Also print the Keeper nodes of the tables, as they are backed up",
+				},
+			),
+		},
+		clickhouse: clickhouse,
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		return tool.inspect(c.String("database"), c.Bool("tree"))
+	}
+	return tool.command
+}
+
+func (tool *Tool) inspect(database string, tree bool) error {
+	if err := tool.clickhouse.Connect(""); err != nil {
+		return err
+	}
+	defer tool.clickhouse.CloseConnection()
+	tables, err := tool.clickhouse.ReplicatedTables(database)
+	if err != nil {
+		return err
+	}
+	result := &Result{Database: database, Replicas: []clickhouse.KeeperReplica{}}
+	output.SetResult(result)
+	if len(tables) == 0 {
+		fmt.Println("no replicated tables found")
+		return nil
+	}
+	for i, table := range tables {
+		replicas, err := tool.clickhouse.KeeperReplicas(table.Table, table.ZooKeeperPath)
+		if err != nil {
+			return err
+		}
+		result.Replicas = append(result.Replicas, replicas...)
+		if tree {
+			if tables[i].Nodes, err = tool.clickhouse.KeeperTree(table.ZooKeeperPath); err != nil {
+				return err
+			}
+		}
+	}
+	clickhouse.PrintKeeperReplicas(helper.ColorReset, result.Replicas)
+	if tree {
+		result.Tables = tables
+		for _, table := range tables {
+			fmt.Println()
+			fmt.Printf("%s (%s):\n", table.Table, table.ZooKeeperPath)
+			for _, node := range table.Nodes {
+				fmt.Println(node.Path)
+			}
+		}
+	}
+	return nil
+}
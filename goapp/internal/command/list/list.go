@@ -1,9 +1,13 @@
 package list
 
 import (
+	"clickhouse-tools/internal/helper"
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
 	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/internal/service/storage/types"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -12,13 +16,21 @@ import (
 	"path"
 	"regexp"
 	"sort"
-	"time"
+	"strings"
 )
 
 const (
-	remote = "remote"
+	remote   = "remote"
+	sortDate = "date"
+	sortName = "name"
+	sortSize = "size"
 )
 
+// Result lists the backups in the json output.
+type Result struct {
+	Backups []storage.BackupInfo `json:"backups"`
+}
+
 type Tool struct {
 	config  *config.Application
 	command *cli.Command
@@ -29,19 +41,13 @@ type Paths struct {
 	local, remote string
 }
 
-type Backup struct {
-	Name string
-	Size int64
-	Date time.Time
-}
-
 func New(cliApp *cli.App, conf *config.Application) *Tool {
 	return &Tool{
 		config: conf,
 		command: &cli.Command{
 			Name:        "list",
 			Usage:       "Print backup list",
-			UsageText:   "clickhouse-tools list [-s, --storage=<storage>] [local|remote]",
+			UsageText:   "clickhouse-tools list [-s, --storage=<storage>] [-db, --database=<database>] [--sort=(date|name|size)] [local|remote]",
 			Description: "Print backup list. Default: local",
 			Flags: append(cliApp.Flags,
 				&cli.StringFlag{
@@ -50,6 +56,20 @@ func New(cliApp *cli.App, conf *config.Application) *Tool {
 					Hidden:   false,
 					Required: false,
 				},
+				&cli.StringFlag{
+					Name:     "database",
+					Aliases:  []string{"db"},
+					Usage:    "show only backups of the database",
+					Hidden:   false,
+					Required: false,
+				},
+				&cli.StringFlag{
+					Name:     "sort",
+					Usage:    "sort by date (newest first), name or size (largest first)",
+					Value:    sortDate,
+					Hidden:   false,
+					Required: false,
+				},
 			),
 		},
 		paths: &Paths{
@@ -67,81 +87,107 @@ func (tool *Tool) GetCommand() *cli.Command {
 }
 
 func (tool *Tool) list(c *cli.Context, direction, storageName string) error {
+	var (
+		backupList []storage.BackupInfo
+		err        error
+	)
+	switch c.String("sort") {
+	case sortDate, sortName, sortSize:
+	default:
+		return output.UsageError(c, fmt.Errorf("unsupported sort '%s'", c.String("sort")))
+	}
 	switch direction {
 	case remote:
 		if storageName == "" {
-			log.Errorf("%+v", errors.New("storage must be defined for remote list"))
-			cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+			return output.UsageError(c, errors.New("storage must be defined for remote list"))
 		}
-		return tool.printRemoteBackupList(storageName)
+		backupList, err = tool.getRemoteBackupList(storageName)
 	default:
-		return tool.printLocalBackupList()
-	}
-}
-
-func (tool *Tool) printRemoteBackupList(storageName string) error {
-	storageObj, err := storage.InitStorage(tool.config, storageName)
-	if err != nil {
-		return err
+		backupList, err = tool.getLocalBackupList()
 	}
-	listString, err := storageObj.GetBackupListString()
 	if err != nil {
 		return err
 	}
-	var backupList []Backup
-	var re = regexp.MustCompile(`(?m)(?P<Date>\d{4}\/\d{2}\/\d{2} \d{2}:\d{2}:\d{2}) (?P<Name>[a-z_]*\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}[a-z0-9.]+)$`)
-	for _, match := range re.FindAllStringSubmatch(listString, -1) {
-		date, _ := time.Parse("2006/01/02 15:04:05", match[1])
-		backupList = append(backupList, Backup{
-			Name: match[2],
-			Date: date,
-		})
+	if database := c.String("database"); database != "" {
+		backupList = filterByDatabase(backupList, database)
 	}
-	tool.printBackupList(backupList, false)
+	sortBackupList(backupList, c.String("sort"))
+	output.SetResult(&Result{Backups: append([]storage.BackupInfo{}, backupList...)})
+	tool.printBackupList(backupList, true)
 	return nil
 }
 
-func (tool *Tool) printLocalBackupList() error {
-	dir, err := os.Open(tool.paths.local)
+func (tool *Tool) getRemoteBackupList(storageName string) ([]storage.BackupInfo, error) {
+	storageObj, err := storage.InitStorage(tool.config, storageName)
 	if err != nil {
-		log.Errorf("%+v", err)
-		return err
+		return nil, err
 	}
-	names, err := dir.Readdirnames(0)
+	return storageObj.List()
+}
+
+func (tool *Tool) getLocalBackupList() ([]storage.BackupInfo, error) {
+	entries, err := os.ReadDir(tool.paths.local)
 	if err != nil {
 		log.Errorf("%+v", err)
-		return err
+		return nil, err
 	}
-	var backupList []Backup
-	for _, name := range names {
-		info, err := os.Stat(path.Join(tool.paths.local, name))
+	var backupList []storage.BackupInfo
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), s3.StateExtension) {
+			continue
+		}
+		info, err := entry.Info()
 		if err != nil {
 			continue
 		}
-		backupList = append(backupList, Backup{
-			Name: info.Name(),
-			Date: info.ModTime(),
-		})
+		backupList = append(backupList, types.NewBackupInfo(info.Name(), info.Size(), info.ModTime()))
 	}
-	tool.printBackupList(backupList, false)
-	return nil
+	return backupList, nil
+}
+
+// filterByDatabase keeps backups named "<database>_<timestamp>...", the
+// format created by the backup command.
+func filterByDatabase(backupList []storage.BackupInfo, database string) []storage.BackupInfo {
+	var filtered []storage.BackupInfo
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(database) + `_\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}`)
+	for _, backup := range backupList {
+		if re.MatchString(backup.Name) {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
+}
+
+func sortBackupList(backupList []storage.BackupInfo, sortBy string) {
+	sort.SliceStable(backupList, func(i, j int) bool {
+		switch sortBy {
+		case sortName:
+			return backupList[i].Name < backupList[j].Name
+		case sortSize:
+			return backupList[i].Size > backupList[j].Size
+		default:
+			return backupList[i].ModTime.After(backupList[j].ModTime)
+		}
+	})
 }
 
-func (tool *Tool) printBackupList(backupList []Backup, printSize bool) {
+func (tool *Tool) printBackupList(backupList []storage.BackupInfo, printSize bool) {
 	if len(backupList) == 0 {
 		fmt.Println("no backups found")
 		return
 	}
-	sort.SliceStable(backupList, func(i, j int) bool {
-		return backupList[i].Date.After(backupList[j].Date)
-	})
-	if printSize {
-		for _, backup := range backupList {
-			fmt.Printf("- '%s'\t%s\t(created at %s)\n", backup.Name, backup.Size, backup.Date.Format("02-01-2006 15:04:05"))
+	for _, backup := range backupList {
+		fmt.Printf("- '%s'\t", backup.Name)
+		if printSize {
+			fmt.Printf("%s\t", helper.FormatBytes(backup.Size))
+		}
+		fmt.Printf("(created at %s)", backup.ModTime.Format("02-01-2006 15:04:05"))
+		if backup.Volumes > 1 {
+			fmt.Printf("\t%d volumes", backup.Volumes)
 		}
-	} else {
-		for _, backup := range backupList {
-			fmt.Printf("- '%s'\t(created at %s)\n", backup.Name, backup.Date.Format("02-01-2006 15:04:05"))
+		if backup.Encrypted {
+			helper.ColoredPrint(helper.ColorYellow, "\tencrypted")
 		}
+		fmt.Println()
 	}
 }
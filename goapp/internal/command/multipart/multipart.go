@@ -0,0 +1,114 @@
+package multipart
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/internal/service/storage/types"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"time"
+)
+
+// Result lists the unfinished uploads in the json output.
+type Result struct {
+	Uploads []UploadResult `json:"uploads"`
+}
+
+type UploadResult struct {
+	types.MultipartUpload
+	Aborted bool   `json:"aborted"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Tool struct {
+	config  *config.Application
+	command *cli.Command
+}
+
+func New(cliApp *cli.App, conf *config.Application) *Tool {
+	return &Tool{
+		config: conf,
+		command: &cli.Command{
+			Name:        "multipart",
+			Usage:       "List and abort unfinished multipart uploads",
+			UsageText:   "clickhouse-tools multipart [-s, --storage=<storage>] [--abort] [--older-than=<duration>]",
+			Description: "List unfinished multipart uploads under the storage prefix and abort the stale ones",
+			Flags: append(cliApp.Flags,
+				&cli.StringFlag{
+					Name:     "storage",
+					Aliases:  []string{"s"},
+					Hidden:   false,
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "abort",
+					Usage: "Abort uploads older than --older-than",
+				},
+				&cli.DurationFlag{
+					Name:  "older-than",
+					Usage: "Minimal age of an upload to abort",
+					Value: 24 * time.Hour,
+				},
+			),
+		},
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		return tool.multipart(c.String("storage"), c.Bool("abort"), c.Duration("older-than"))
+	}
+	return tool.command
+}
+
+func (tool *Tool) multipart(storageName string, abort bool, olderThan time.Duration) error {
+	storageObj, err := storage.InitStorage(tool.config, storageName)
+	if err != nil {
+		return err
+	}
+	multipartStorage, ok := storage.Unwrap(storageObj).(storage.MultipartInterface)
+	if !ok {
+		err := fmt.Errorf("storage '%s' does not support multipart uploads", storageName)
+		log.Errorf("%+v", err)
+		return err
+	}
+	uploads, err := multipartStorage.ListMultipartUploads()
+	if err != nil {
+		return err
+	}
+	result := &Result{Uploads: []UploadResult{}}
+	output.SetResult(result)
+	if len(uploads) == 0 {
+		fmt.Println("No unfinished multipart uploads")
+		return nil
+	}
+	var failed int
+	for _, upload := range uploads {
+		age := time.Since(upload.Initiated).Truncate(time.Second)
+		fmt.Printf("%s\t%s\t%s\t%s ago", upload.Initiated.Format(time.DateTime), upload.Key, upload.UploadId, age)
+		result.Uploads = append(result.Uploads, UploadResult{MultipartUpload: upload})
+		uploadResult := &result.Uploads[len(result.Uploads)-1]
+		if !abort || age < olderThan {
+			fmt.Println()
+			continue
+		}
+		fmt.Print("\tabort...")
+		if err := multipartStorage.AbortMultipartUpload(upload); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			uploadResult.Error = err.Error()
+			failed++
+			continue
+		}
+		uploadResult.Aborted = true
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+	}
+	if failed > 0 {
+		err := fmt.Errorf("can't abort %d multipart uploads", failed)
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package command
+
+import (
+	"clickhouse-tools/internal/service/output"
+	"github.com/urfave/cli/v2"
+	"os"
+	"time"
+)
+
+func outputFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Usage:    "output format: text or json, a single document on stdout",
+			Value:    output.FormatText,
+			Hidden:   false,
+			Required: false,
+		},
+	}
+}
+
+// applyOutput switches the format, the help and the usage errors are written
+// to the stdout of the messages then.
+func applyOutput(c *cli.Context) error {
+	if err := output.Init(c.String("output")); err != nil {
+		return err
+	}
+	c.App.Writer = os.Stdout
+	return nil
+}
+
+// reported writes the json document of the command when it finishes.
+func reported(action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		started := time.Now()
+		err := action(c)
+		output.Write(c.Command.Name, err, time.Since(started))
+		return err
+	}
+}
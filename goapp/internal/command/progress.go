@@ -0,0 +1,28 @@
+package command
+
+import (
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/pkg/progress"
+	"github.com/urfave/cli/v2"
+)
+
+func progressFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:     "no-progress",
+			Usage:    "don't report progress of long phases",
+			Hidden:   false,
+			Required: false,
+		},
+	}
+}
+
+func applyProgress(conf *config.Application) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		if c.Bool("no-progress") {
+			conf.Progress.Enabled = false
+		}
+		progress.Configure(conf.Progress)
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package remove
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Result describes the deleted backup in the json output.
+type Result struct {
+	BackupName string `json:"backup_name"`
+	Storage    string `json:"storage"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+}
+
+type Tool struct {
+	config  *config.Application
+	command *cli.Command
+}
+
+func New(cliApp *cli.App, conf *config.Application) *Tool {
+	return &Tool{
+		config: conf,
+		command: &cli.Command{
+			Name:        "delete",
+			Usage:       "Delete backup from remote storage",
+			UsageText:   "clickhouse-tools delete [-s, --storage=<storage>] [--dry-run] <backup_name>",
+			Description: "Delete backup from remote storage",
+			Flags: append(cliApp.Flags,
+				&cli.StringFlag{
+					Name:     "storage",
+					Aliases:  []string{"s"},
+					Hidden:   false,
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Check the backup exists and print what would be deleted",
+				},
+			),
+		},
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		return tool.delete(c, c.Args().First(), c.String("storage"))
+	}
+	return tool.command
+}
+
+func (tool *Tool) delete(c *cli.Context, backupName, storageName string) error {
+	if backupName == "" {
+		return output.UsageError(c, errors.New("backup name must be defined"))
+	}
+	fmt.Println("Starting delete backup!")
+	storageObj, err := storage.InitStorage(tool.config, storageName)
+	if err != nil {
+		return err
+	}
+	output.SetResult(&Result{BackupName: backupName, Storage: storageName, DryRun: c.Bool("dry-run")})
+	if c.Bool("dry-run") {
+		return tool.plan(storageObj, backupName, storageName)
+	}
+	if err := storageObj.Delete(backupName); err != nil {
+		return err
+	}
+	fmt.Println("Successful finish delete backup!")
+	return nil
+}
+
+// plan prints the backup the delete would remove without removing it.
+func (tool *Tool) plan(storageObj storage.Interface, backupName, storageName string) error {
+	backupList, err := storageObj.List()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backupList {
+		if backup.Name != backupName {
+			continue
+		}
+		helper.ColoredPrintln(helper.ColorYellow, "Dry run, nothing will be changed")
+		fmt.Printf("Would delete '%s' (%s) from storage '%s'", backup.Name, helper.FormatBytes(backup.Size), storageName)
+		if backup.Volumes > 1 {
+			fmt.Printf(", %d volumes", backup.Volumes)
+		}
+		fmt.Println()
+		return nil
+	}
+	err = fmt.Errorf("backup '%s' not found on storage '%s'", backupName, storageName)
+	log.Errorf("%+v", err)
+	return err
+}
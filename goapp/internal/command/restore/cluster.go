@@ -0,0 +1,240 @@
+package restore
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClusterResult describes the restore of a cluster backup in the json output.
+type ClusterResult struct {
+	BackupName string        `json:"backup_name"`
+	Database   string        `json:"database"`
+	Cluster    string        `json:"cluster"`
+	Storage    string        `json:"storage,omitempty"`
+	DryRun     bool          `json:"dry_run,omitempty"`
+	Shards     []ShardResult `json:"shards"`
+}
+
+// ShardResult is the restore of the archive of a shard on its replica.
+type ShardResult struct {
+	clickhouse.Replica
+	Backup string  `json:"backup"`
+	Result *Result `json:"result,omitempty"`
+}
+
+// restoreCluster restores every shard archive of the cluster backup on a
+// healthy replica of the same shard. The first shard recreates the database
+// and the tables on the cluster, the others only restore their data. Remote
+// replicas run the restore command over ssh.
+func (tool *Tool) restoreCluster(manifestName string, opts options) error {
+	result := &ClusterResult{
+		BackupName: manifestName,
+		Database:   opts.database,
+		Cluster:    opts.cluster,
+		Storage:    opts.storage,
+		DryRun:     opts.dryRun,
+	}
+	output.SetResult(result)
+	if opts.safety != "" || !opts.inCluster {
+		err := errors.New("a cluster backup is restored only on a cluster and without a safety backup")
+		log.Errorf("%+v", err)
+		return err
+	}
+	manifest, err := tool.clusterManifest(manifestName, opts.storage)
+	if err != nil {
+		return err
+	}
+	replicas, err := tool.shardReplicas(manifest, opts.cluster)
+	if err != nil {
+		return err
+	}
+	count, err := tool.clickhouse.CountTables(opts.database)
+	if err != nil {
+		return err
+	}
+	if opts.dryRun {
+		helper.ColoredPrintln(helper.ColorYellow, "Dry run, nothing will be changed")
+	} else if err := tool.ConfirmDrop(opts.database, count, opts.yes); err != nil {
+		return err
+	}
+	fmt.Printf("Starting restore of cluster backup '%s'!\n", manifestName)
+	for i, shard := range manifest.Shards {
+		replica := replicas[shard.Shard]
+		shardOpts := opts
+		shardOpts.yes, shardOpts.dataOnly, shardOpts.scope = true, i > 0, scopeShard
+		shardResult := ShardResult{
+			Replica: replica,
+			Backup:  shard.Backup,
+			Result:  &Result{BackupName: shard.Backup, Database: opts.database, Storage: opts.storage, Cluster: opts.cluster},
+		}
+		result.Shards = append(result.Shards, shardResult)
+		if opts.dryRun {
+			fmt.Printf("-- restore '%s' of shard %d on replica %d '%s'", shard.Backup, shard.Shard, replica.Replica, replica.Host)
+			if shardOpts.dataOnly {
+				fmt.Print(", data only")
+			}
+			fmt.Println()
+			continue
+		}
+		helper.ColoredPrintln(helper.ColorCyan, fmt.Sprintf("Restore shard %d on replica %d '%s'", shard.Shard, replica.Replica, replica.Host))
+		if err := tool.restoreOn(shard.Backup, replica, shardOpts, shardResult.Result); err != nil {
+			return err
+		}
+	}
+	if !opts.dryRun {
+		fmt.Printf("Successful finish restore of cluster backup '%s'!\n", manifestName)
+	}
+	return nil
+}
+
+// clusterManifest reads the cluster manifest from the local backups or from
+// the storage.
+func (tool *Tool) clusterManifest(manifestName, storageName string) (*clickhouse.ClusterManifest, error) {
+	manifestPath := path.Join(tool.paths.base, manifestName)
+	if storageName != "" {
+		storageObj, err := storage.InitStorage(tool.config, storageName)
+		if err != nil {
+			return nil, err
+		}
+		tmpDir, err := os.MkdirTemp(tool.paths.base, "restore-")
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		defer removeAll(tmpDir)
+		manifestPath = path.Join(tmpDir, manifestName)
+		if err := storageObj.Download(manifestPath, manifestName); err != nil {
+			return nil, err
+		}
+	}
+	manifest, err := clickhouse.ReadClusterManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Shards) == 0 {
+		log.Errorf("%+v", clickhouse.ErrNoShards)
+		return nil, clickhouse.ErrNoShards
+	}
+	return manifest, nil
+}
+
+// shardReplicas picks a healthy replica of the cluster for every shard of the
+// backup. The cluster must have the same shards as the backed up one.
+func (tool *Tool) shardReplicas(manifest *clickhouse.ClusterManifest, cluster string) (map[uint32]clickhouse.Replica, error) {
+	replicas, err := tool.clickhouse.GetReplicas(cluster)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("Choose replicas...")
+	if replicas, err = tool.clickhouse.HealthyReplicas(replicas); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return nil, err
+	}
+	byShard := map[uint32]clickhouse.Replica{}
+	for _, replica := range replicas {
+		byShard[replica.Shard] = replica
+	}
+	if err := compareShards(manifest, byShard, cluster); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return byShard, nil
+}
+
+// compareShards reports the shards of the backup missing in the cluster and
+// the shards of the cluster missing in the backup.
+func compareShards(manifest *clickhouse.ClusterManifest, byShard map[uint32]clickhouse.Replica, cluster string) error {
+	inBackup := map[uint32]bool{}
+	var missing, extra []uint32
+	for _, shard := range manifest.Shards {
+		inBackup[shard.Shard] = true
+		if _, ok := byShard[shard.Shard]; !ok {
+			missing = append(missing, shard.Shard)
+		}
+	}
+	for shard := range byShard {
+		if !inBackup[shard] {
+			extra = append(extra, shard)
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("shards %s of the backup are missing in the cluster", joinShards(missing)))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, fmt.Sprintf("shards %s of the cluster are missing in the backup", joinShards(extra)))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("cluster '%s' doesn't match the backup of cluster '%s': %s", cluster, manifest.Cluster, strings.Join(problems, "; "))
+}
+
+func joinShards(shards []uint32) string {
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	numbers := make([]string, len(shards))
+	for i, shard := range shards {
+		numbers[i] = strconv.FormatUint(uint64(shard), 10)
+	}
+	return strings.Join(numbers, ", ")
+}
+
+// restoreOn restores the archive on the replica, sending the local archive
+// to a remote replica unless it is fetched from the storage.
+func (tool *Tool) restoreOn(backupName string, replica clickhouse.Replica, opts options, result *Result) error {
+	if replica.IsLocal == 1 {
+		return tool.restoreBackup(backupName, opts, result)
+	}
+	if opts.storage == "" {
+		archivePath := path.Join(tool.paths.base, backupName)
+		fmt.Printf("Send '%s' to '%s'...", backupName, replica.Host)
+		if err := tool.agent.Send(replica.Host, archivePath, archivePath); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+		defer func() {
+			if err := tool.agent.Remove(replica.Host, archivePath); err != nil {
+				log.Warnf("archive '%s' is left on '%s'", archivePath, replica.Host)
+			}
+		}()
+	}
+	args := []string{"restore", "-c", opts.cluster, "-db", opts.database, "--yes"}
+	if opts.storage != "" {
+		args = append(args, "-s", opts.storage)
+	}
+	if opts.dataOnly {
+		args = append(args, "--data-only")
+	}
+	if opts.dropStale {
+		args = append(args, "--drop-stale-replicas")
+	}
+	if opts.scope != scopeCluster {
+		args = append(args, "--scope", opts.scope)
+	}
+	for _, table := range opts.tables {
+		args = append(args, "--tables", table)
+	}
+	if opts.timeout > 0 {
+		args = append(args, "--replication-timeout", opts.timeout.String())
+	}
+	fmt.Printf("Restore '%s' on '%s'...", backupName, replica.Host)
+	if err := tool.agent.Run(replica.Host, result, append(args, backupName)...); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
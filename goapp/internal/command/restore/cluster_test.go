@@ -0,0 +1,39 @@
+package restore
+
+import (
+	"clickhouse-tools/internal/service/clickhouse"
+	"testing"
+)
+
+func TestCompareShards(t *testing.T) {
+	manifest := &clickhouse.ClusterManifest{Cluster: "main"}
+	for _, shard := range []uint32{1, 2, 3} {
+		manifest.Shards = append(manifest.Shards, clickhouse.ClusterShard{Replica: clickhouse.Replica{Shard: shard}})
+	}
+	tests := []struct {
+		name     string
+		shards   []uint32
+		expected string
+	}{
+		{name: "same shards", shards: []uint32{1, 2, 3}},
+		{name: "missing shards", shards: []uint32{1}, expected: "cluster 'restored' doesn't match the backup of cluster 'main': shards 2, 3 of the backup are missing in the cluster"},
+		{name: "extra shards", shards: []uint32{1, 2, 3, 4}, expected: "cluster 'restored' doesn't match the backup of cluster 'main': shards 4 of the cluster are missing in the backup"},
+		{
+			name:     "missing and extra shards",
+			shards:   []uint32{1, 5, 4},
+			expected: "cluster 'restored' doesn't match the backup of cluster 'main': shards 2, 3 of the backup are missing in the cluster; shards 4, 5 of the cluster are missing in the backup",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			byShard := map[uint32]clickhouse.Replica{}
+			for _, shard := range test.shards {
+				byShard[shard] = clickhouse.Replica{Shard: shard}
+			}
+			err := compareShards(manifest, byShard, "restored")
+			if test.expected == "" && err != nil || test.expected != "" && (err == nil || err.Error() != test.expected) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package restore
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/clickhouse"
+	"fmt"
+	"sort"
+)
+
+// Scopes of the data restore on a cluster: all the shards, the replicas of
+// the local shard or only the local replica.
+const (
+	scopeCluster = ""
+	scopeShard   = "shard"
+	scopeLocal   = "local"
+)
+
+// ReplicaResult is the restore of the data of the tables on a replica.
+type ReplicaResult struct {
+	clickhouse.Replica
+	Tables []string `json:"tables"`
+	Result *Result  `json:"result,omitempty"`
+}
+
+// replicaTargets plans the data restore on the other replicas after the
+// local one. Replicated tables are attached on one replica of every other
+// shard and fetched by the rest of the replicas, plain MergeTree tables are
+// restored on every replica. In the shard scope only the replicas of the
+// local shard are restored.
+func (tool *Tool) replicaTargets(opts options, engines map[string]string) ([]ReplicaResult, error) {
+	var replicated, plain []string
+	for table, engine := range engines {
+		if !clickhouse.IsMergeTree(engine) || !selected(table, opts.tables) {
+			continue
+		}
+		if clickhouse.IsReplicated(engine) {
+			replicated = append(replicated, table)
+		} else {
+			plain = append(plain, table)
+		}
+	}
+	sort.Strings(replicated)
+	sort.Strings(plain)
+	replicas, err := tool.clickhouse.GetReplicas(opts.cluster)
+	if err != nil {
+		return nil, err
+	}
+	healthy, err := tool.clickhouse.HealthyReplicas(replicas)
+	if err != nil {
+		return nil, err
+	}
+	var localShard uint32
+	for _, replica := range replicas {
+		if replica.IsLocal == 1 {
+			localShard = replica.Shard
+		}
+	}
+	chosen := map[uint32]clickhouse.Replica{}
+	for _, replica := range healthy {
+		chosen[replica.Shard] = replica
+	}
+	var targets []ReplicaResult
+	for _, replica := range replicas {
+		if replica.IsLocal == 1 || opts.scope == scopeShard && replica.Shard != localShard {
+			continue
+		}
+		tables := append([]string{}, plain...)
+		if replica.Shard != localShard && chosen[replica.Shard] == replica {
+			tables = append(tables, replicated...)
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		targets = append(targets, ReplicaResult{
+			Replica: replica,
+			Tables:  tables,
+			Result:  &Result{Database: opts.database, Storage: opts.storage, Cluster: opts.cluster},
+		})
+	}
+	return targets, nil
+}
+
+// restoreReplicas restores the data on the planned replicas, then waits for
+// the replication queues of the replicated tables to drain on every replica
+// in the scope.
+func (tool *Tool) restoreReplicas(backupName string, opts options, targets []ReplicaResult, engines map[string]string) error {
+	replicaOpts := opts
+	replicaOpts.yes, replicaOpts.dataOnly, replicaOpts.scope, replicaOpts.safety = true, true, scopeLocal, ""
+	for _, target := range targets {
+		helper.ColoredPrintln(helper.ColorCyan, fmt.Sprintf("Restore data on replica %d of shard %d '%s'", target.Replica.Replica, target.Shard, target.Host))
+		replicaOpts.tables = target.Tables
+		target.Result.BackupName = backupName
+		if err := tool.restoreOn(backupName, target.Replica, replicaOpts, target.Result); err != nil {
+			return err
+		}
+	}
+	hasReplicated := false
+	for table, engine := range engines {
+		if clickhouse.IsReplicated(engine) && selected(table, opts.tables) {
+			hasReplicated = true
+		}
+	}
+	if !hasReplicated {
+		return nil
+	}
+	replicas, err := tool.clickhouse.GetReplicas(opts.cluster)
+	if err != nil {
+		return err
+	}
+	var localShard uint32
+	for _, replica := range replicas {
+		if replica.IsLocal == 1 {
+			localShard = replica.Shard
+		}
+	}
+	for _, replica := range replicas {
+		if opts.scope == scopeShard && replica.Shard != localShard {
+			continue
+		}
+		client := tool.clickhouse.ForReplica(replica)
+		if err := client.Connect(""); err != nil {
+			return err
+		}
+		err := client.WaitReplication(opts.database, opts.timeout)
+		client.CloseConnection()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selected reports whether the table is listed, every table is selected by
+// an empty list.
+func selected(table string, tables []string) bool {
+	for _, name := range tables {
+		if name == table {
+			return true
+		}
+	}
+	return len(tables) == 0
+}
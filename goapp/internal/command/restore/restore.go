@@ -1,25 +1,64 @@
 package restore
 
 import (
+	backupCommand "clickhouse-tools/internal/command/backup"
+	"clickhouse-tools/internal/helper"
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/remote"
+	"clickhouse-tools/internal/service/storage"
 	"clickhouse-tools/pkg/archiver"
+	"clickhouse-tools/pkg/encryptor"
+	"clickhouse-tools/pkg/progress"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"io"
+	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 const (
-	backup = "backup"
+	backup       = "backup"
+	safetyRename = "rename"
+	safetyBackup = "backup"
 )
 
+// Result describes the restore in the json output.
+type Result struct {
+	BackupName string `json:"backup_name"`
+	Database   string `json:"database"`
+	Storage    string `json:"storage,omitempty"`
+	Cluster    string `json:"cluster,omitempty"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+	// SafetyBackup is the snapshot database or the local backup kept by
+	// --safety-backup, RolledBack is set when the failed restore was undone.
+	SafetyBackup string `json:"safety_backup,omitempty"`
+	RolledBack   bool   `json:"rolled_back,omitempty"`
+	// RestoreReport lists the attached, skipped and failed parts and the
+	// mismatches with the backup manifest.
+	clickhouse.RestoreReport
+	// StaleReplicas are the inactive replicas in Keeper under the paths of
+	// the restored tables, dropped with --drop-stale-replicas.
+	StaleReplicas []clickhouse.KeeperReplica `json:"stale_replicas,omitempty"`
+	// Replicas lists the restores of the data on the other replicas.
+	Replicas []ReplicaResult `json:"replicas,omitempty"`
+	// Statements and Moves are planned by --dry-run, in the execution order.
+	Statements []string          `json:"statements,omitempty"`
+	Moves      []clickhouse.Move `json:"moves,omitempty"`
+}
+
 type Tool struct {
 	config     *config.Application
 	command    *cli.Command
 	clickhouse *clickhouse.Client
 	archiver   *archiver.Archiver
+	backupTool *backupCommand.Tool
+	agent      *remote.Agent
 	paths      *Paths
 }
 
@@ -27,16 +66,18 @@ type Paths struct {
 	base string
 }
 
-func New(cliApp *cli.App, conf *config.Application, clickhouseClient *clickhouse.Client, archiver *archiver.Archiver) *Tool {
+func New(cliApp *cli.App, conf *config.Application, clickhouseClient *clickhouse.Client, archiver *archiver.Archiver, backupTool *backupCommand.Tool, agent *remote.Agent) *Tool {
 	basePath := path.Join(clickhouse.DefaultDataPath, backup)
 	return &Tool{
 		config:     conf,
 		clickhouse: clickhouseClient,
 		archiver:   archiver,
+		backupTool: backupTool,
+		agent:      agent,
 		command: &cli.Command{
 			Name:        "restore",
 			Usage:       "Restore backup",
-			UsageText:   "clickhouse-tools restore [-c, --cluster=<cluster>] [-db, --database=<database>] <backup_name>",
+			UsageText:   "clickhouse-tools restore [-c, --cluster=<cluster>] [-db, --database=<database>] [-s, --storage=<storage>] [--safety-backup=(rename|backup)] [--dry-run] [-y, --yes] <backup_name>",
 			Description: "Restore backup",
 			Flags: append(cliApp.Flags,
 				&cli.StringFlag{
@@ -51,6 +92,53 @@ func New(cliApp *cli.App, conf *config.Application, clickhouseClient *clickhouse
 					Hidden:   false,
 					Required: true,
 				},
+				&cli.StringFlag{
+					Name:    "storage",
+					Aliases: []string{"s"},
+					Usage:   "Fetch the backup from the remote storage",
+					Hidden:  false,
+				},
+				&cli.StringFlag{
+					Name:  "safety-backup",
+					Usage: "Keep the current database before dropping it: 'rename' it to <database>_pre_restore_<timestamp> or create a local 'backup'",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the SQL statements and file moves of the restore without executing them",
+				},
+				// data-only is passed by a cluster restore to the shards
+				// after the first one, which created the tables on the cluster.
+				&cli.BoolFlag{
+					Name:   "data-only",
+					Usage:  "Restore only the data into the existing tables",
+					Hidden: true,
+				},
+				// scope and tables are passed to the replicas restoring the
+				// data of a restore on the cluster.
+				&cli.StringFlag{
+					Name:   "scope",
+					Usage:  "Restore the data on the replicas of the cluster, of the 'shard' or only 'local'",
+					Hidden: true,
+				},
+				&cli.StringSliceFlag{
+					Name:   "tables",
+					Usage:  "Restore only the data of the tables",
+					Hidden: true,
+				},
+				&cli.DurationFlag{
+					Name:  "replication-timeout",
+					Usage: "How long to wait for the replication queues of the replicas to drain",
+					Value: time.Hour,
+				},
+				&cli.BoolFlag{
+					Name:  "drop-stale-replicas",
+					Usage: "Drop the inactive replicas left in Keeper under the paths of the restored tables with SYSTEM DROP REPLICA",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Drop the existing non-empty database without confirmation",
+				},
 			),
 		},
 		paths: &Paths{
@@ -61,13 +149,42 @@ func New(cliApp *cli.App, conf *config.Application, clickhouseClient *clickhouse
 
 func (tool *Tool) GetCommand() *cli.Command {
 	tool.command.Action = func(c *cli.Context) error {
-		return tool.restore(c, c.Args().First(), c.String("cluster"), c.String("database"))
+		return tool.restore(c, c.Args().First(), options{
+			cluster:   c.String("cluster"),
+			database:  c.String("database"),
+			storage:   c.String("storage"),
+			safety:    c.String("safety-backup"),
+			dryRun:    c.Bool("dry-run"),
+			yes:       c.Bool("yes"),
+			dataOnly:  c.Bool("data-only"),
+			scope:     c.String("scope"),
+			tables:    c.StringSlice("tables"),
+			timeout:   c.Duration("replication-timeout"),
+			dropStale: c.Bool("drop-stale-replicas"),
+		})
 	}
 	return tool.command
 }
 
-func (tool *Tool) restore(c *cli.Context, backupName, cluster, database string) error {
-	inCluster := false
+// options are the flags of a restore.
+type options struct {
+	cluster, database, storage, safety, scope   string
+	inCluster, dryRun, yes, dataOnly, dropStale bool
+	tables                                      []string
+	timeout                                     time.Duration
+}
+
+func (tool *Tool) restore(c *cli.Context, backupName string, opts options) error {
+	switch opts.safety {
+	case "", safetyRename, safetyBackup:
+	default:
+		return output.UsageError(c, fmt.Errorf("unsupported safety backup '%s'", opts.safety))
+	}
+	switch opts.scope {
+	case scopeCluster, scopeShard, scopeLocal:
+	default:
+		return output.UsageError(c, fmt.Errorf("unsupported scope '%s'", opts.scope))
+	}
 	if err := tool.clickhouse.Connect(""); err != nil {
 		return err
 	}
@@ -77,25 +194,370 @@ func (tool *Tool) restore(c *cli.Context, backupName, cluster, database string)
 		return err
 	}
 	if len(clusters) > 0 {
-		inCluster = true
+		opts.inCluster = true
 	}
 	if backupName == "" {
-		log.Errorf("%+v", errors.New("backup name must be defined"))
-		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+		return output.UsageError(c, errors.New("backup name must be defined"))
+	}
+	if clickhouse.IsClusterManifest(backupName) {
+		return tool.restoreCluster(backupName, opts)
+	}
+	result := &Result{BackupName: backupName, Database: opts.database, Storage: opts.storage}
+	if opts.inCluster {
+		result.Cluster = opts.cluster
+	}
+	output.SetResult(result)
+	return tool.restoreBackup(backupName, opts, result)
+}
+
+// restoreBackup restores the backup into the database. With data only the
+// tables are expected to exist and only their data is restored.
+func (tool *Tool) restoreBackup(backupName string, opts options, result *Result) error {
+	database, cluster, inCluster := opts.database, opts.cluster, opts.inCluster
+	var count int
+	if !opts.dataOnly {
+		var err error
+		if count, err = tool.clickhouse.CountTables(database); err != nil {
+			return err
+		}
+	}
+	if opts.dryRun {
+		result.DryRun = true
+	} else if err := tool.ConfirmDrop(database, count, opts.yes); err != nil {
+		return err
+	}
+	srcPath := path.Join(tool.paths.base, strings.TrimSuffix(backupName, encryptor.Extension))
+	dstPath := strings.TrimSuffix(srcPath, "."+tool.archiver.GetExtension())
+	if opts.storage == "" {
+		if opts.dryRun {
+			defer removeAll(dstPath)
+		}
+		if err := tool.archiver.Unarchive(srcPath, dstPath); err != nil {
+			return err
+		}
+	} else {
+		defer removeAll(dstPath)
+		if err := tool.fetch(opts.storage, backupName, srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	engines, err := clickhouse.SchemaEngines(dstPath)
+	if err != nil {
+		return err
+	}
+	if inCluster && opts.scope != scopeLocal {
+		if result.Replicas, err = tool.replicaTargets(opts, engines); err != nil {
+			return err
+		}
+	}
+	if !opts.dataOnly {
+		if result.StaleReplicas, err = tool.staleReplicas(opts, dstPath); err != nil {
+			return err
+		}
+	}
+	if opts.dryRun {
+		return tool.plan(result, count, opts, dstPath)
+	}
+	if count > 0 && opts.safety != "" {
+		if result.SafetyBackup, err = tool.safetyBackup(opts.safety, database, cluster, inCluster); err != nil {
+			return err
+		}
+	}
+	err = tool.clickhouse.DropReplicas(result.StaleReplicas)
+	if err == nil {
+		result.RestoreReport, err = tool.apply(database, cluster, inCluster, dstPath, opts.dataOnly, opts.tables)
+	}
+	if err == nil && inCluster && opts.scope != scopeLocal {
+		err = tool.restoreReplicas(backupName, opts, result.Replicas, engines)
+	}
+	if err != nil {
+		if result.SafetyBackup != "" {
+			helper.ColoredPrintln(helper.ColorYellow, fmt.Sprintf("Restore failed, roll back to '%s'", result.SafetyBackup))
+			result.RolledBack = tool.Rollback(result.SafetyBackup, database, cluster, inCluster) == nil
+		}
+		return err
+	}
+	if result.SafetyBackup != "" {
+		fmt.Printf("Previous data is kept in '%s', run 'rollback' to bring it back\n", result.SafetyBackup)
+	}
+	return nil
+}
+
+// staleReplicas finds the stale replicas blocking the creation of the tables
+// of the backup extracted to dstPath. They must be allowed to be dropped,
+// unless the restore is only planned.
+func (tool *Tool) staleReplicas(opts options, dstPath string) ([]clickhouse.KeeperReplica, error) {
+	queries, err := clickhouse.SchemaQueries(opts.database, dstPath, opts.cluster, opts.inCluster)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := tool.clickhouse.StaleReplicas(opts.database, opts.cluster, opts.inCluster, queries)
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 && !opts.dropStale && !opts.dryRun {
+		log.Errorf("%+v", clickhouse.ErrStaleReplicas)
+		return nil, clickhouse.ErrStaleReplicas
+	}
+	return stale, nil
+}
+
+// apply replaces the database by the backup extracted to dstPath, or only
+// restores the data into the existing tables.
+func (tool *Tool) apply(database, cluster string, inCluster bool, dstPath string, dataOnly bool, only []string) (clickhouse.RestoreReport, error) {
+	manifest, err := clickhouse.ReadManifest(dstPath)
+	if err != nil {
+		return clickhouse.RestoreReport{}, err
+	}
+	if !dataOnly {
+		if err := tool.clickhouse.DropAllData(database, cluster, inCluster); err != nil {
+			return clickhouse.RestoreReport{}, err
+		}
+		if err := tool.clickhouse.RestoreTablesSchemas(database, dstPath, cluster, inCluster); err != nil {
+			return clickhouse.RestoreReport{}, err
+		}
+	}
+	return tool.clickhouse.RestoreTablesData(database, path.Join(dstPath, "data"), manifest, only)
+}
+
+// safetyBackup keeps the database before it is dropped and returns the name
+// of the snapshot database or of the local backup.
+func (tool *Tool) safetyBackup(safety, database, cluster string, inCluster bool) (string, error) {
+	if safety == safetyRename {
+		return tool.clickhouse.Snapshot(database, cluster, inCluster)
+	}
+	// The backup tool opens and closes its own connection of the shared client.
+	tool.clickhouse.CloseConnection()
+	backupErr := tool.backupTool.Backup(database)
+	if err := tool.clickhouse.Connect(""); err != nil {
+		return "", err
+	}
+	if backupErr != nil {
+		return "", backupErr
+	}
+	return tool.backupTool.GetArchiveName(), nil
+}
+
+// Rollback replaces the database by the snapshot database or by the local
+// backup kept by --safety-backup.
+func (tool *Tool) Rollback(safetyBackup, database, cluster string, inCluster bool) error {
+	if clickhouse.IsSnapshotOf(safetyBackup, database) {
+		return tool.clickhouse.SwapBack(database, safetyBackup, cluster, inCluster)
 	}
-	srcPath := path.Join(tool.paths.base, backupName)
+	srcPath := path.Join(tool.paths.base, strings.TrimSuffix(safetyBackup, encryptor.Extension))
 	dstPath := strings.TrimSuffix(srcPath, "."+tool.archiver.GetExtension())
+	defer removeAll(dstPath)
 	if err := tool.archiver.Unarchive(srcPath, dstPath); err != nil {
 		return err
 	}
-	if err := tool.clickhouse.DropAllData(database, cluster, inCluster); err != nil {
+	_, err := tool.apply(database, cluster, inCluster, dstPath, false, nil)
+	return err
+}
+
+// ConfirmDrop asks before dropping a database with count tables, unless the
+// drop is confirmed by --yes.
+func (tool *Tool) ConfirmDrop(database string, count int, confirmed bool) error {
+	if count == 0 || confirmed {
+		return nil
+	}
+	var err error
+	question := fmt.Sprintf("Database '%s' has %d tables and will be dropped. Continue?", database, count)
+	if output.IsJSON() {
+		err = errors.New("confirmation required")
+	} else {
+		var ok bool
+		if ok, err = helper.Confirm(question); err == nil && !ok {
+			err = errors.New("restore cancelled")
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("database '%s' has %d tables, use --yes to drop it: %w", database, count, err)
+		log.Errorf("%+v", err)
 		return err
 	}
-	if err := tool.clickhouse.RestoreTablesSchemas(database, dstPath, cluster, inCluster); err != nil {
+	return nil
+}
+
+// plan prints what the restore of the extracted backup would do, in the
+// order it would be done.
+func (tool *Tool) plan(result *Result, count int, opts options, dstPath string) error {
+	database, cluster, inCluster := result.Database, opts.cluster, opts.inCluster
+	schemaQueries, err := clickhouse.SchemaQueries(database, dstPath, cluster, inCluster)
+	if err != nil {
 		return err
 	}
-	if err := tool.clickhouse.RestoreTablesData(database, path.Join(dstPath, "data")); err != nil {
+	tables, err := clickhouse.TablesData(database, path.Join(dstPath, "data"))
+	if err != nil {
 		return err
 	}
+	tables = clickhouse.FilterTables(tables, opts.tables)
+	helper.ColoredPrintln(helper.ColorYellow, "Dry run, nothing will be changed")
+	if count > 0 {
+		helper.ColoredPrintln(helper.ColorYellow, fmt.Sprintf("Database '%s' has %d tables, the restore requires confirmation or --yes", database, count))
+	}
+	statement := func(query string) {
+		result.Statements = append(result.Statements, query)
+		fmt.Printf("%s;\n", query)
+	}
+	if count > 0 && opts.safety == safetyRename {
+		statement(clickhouse.RenameDatabaseQuery(database, clickhouse.SnapshotName(database, time.Now()), cluster, inCluster))
+	} else if count > 0 && opts.safety == safetyBackup {
+		fmt.Printf("-- create local backup of database '%s'\n", database)
+	}
+	for _, replica := range result.StaleReplicas {
+		if opts.dropStale {
+			statement(clickhouse.DropReplicaQuery(replica))
+		} else {
+			fmt.Printf("-- stale replica '%s' of '%s' blocks the restore, use --drop-stale-replicas\n", replica.Replica, replica.ZooKeeperPath)
+		}
+	}
+	if !opts.dataOnly {
+		for _, query := range clickhouse.DropDatabaseQueries(database, cluster, inCluster) {
+			statement(query)
+		}
+		for _, query := range schemaQueries {
+			statement(query.Query)
+		}
+	}
+	var merging []string
+	for _, table := range tables {
+		if len(table.Parts) > 0 {
+			merging = append(merging, table.Name)
+			statement(clickhouse.MergesQuery(database, table.Name, false))
+		}
+	}
+	for _, table := range tables {
+		fmt.Printf("-- move %d files of table '%s'\n", len(table.Moves), table.Name)
+		for _, move := range table.Moves {
+			result.Moves = append(result.Moves, move)
+			fmt.Printf("--   %s -> %s\n", move.Source, move.Destination)
+		}
+		for _, part := range table.Parts {
+			statement(clickhouse.AttachQuery(database, table.Name, part))
+		}
+		for _, skipped := range table.Skipped {
+			result.Parts = append(result.Parts, skipped)
+			fmt.Printf("-- skip part '%s' of table '%s': %s\n", skipped.Part, table.Name, skipped.Error)
+		}
+	}
+	if manifest, err := clickhouse.ReadManifest(dstPath); err != nil {
+		return err
+	} else if manifest != nil {
+		fmt.Printf("-- validate %d partitions against the backup manifest\n", len(manifest.Partitions))
+	} else {
+		fmt.Println("-- backup has no manifest, restored data isn't validated")
+	}
+	for i := len(merging) - 1; i >= 0; i-- {
+		statement(clickhouse.MergesQuery(database, merging[i], true))
+	}
+	for _, replica := range result.Replicas {
+		fmt.Printf("-- restore data of %s on replica %d of shard %d '%s'\n", strings.Join(replica.Tables, ", "), replica.Replica.Replica, replica.Shard, replica.Host)
+	}
 	return nil
 }
+
+// fetch extracts a remote backup to dstPath. A local copy at srcPath is used
+// when it matches the remote backup. Plain backups are extracted right from
+// the stream when the storage supports it, others are downloaded into a
+// temporary directory removed afterwards.
+func (tool *Tool) fetch(storageName, backupName, srcPath, dstPath string) error {
+	storageObj, err := storage.InitStorage(tool.config, storageName)
+	if err != nil {
+		return err
+	}
+	backupList, err := storageObj.List()
+	if err != nil {
+		return err
+	}
+	var remoteBackup *storage.BackupInfo
+	for i := range backupList {
+		if backupList[i].Name == backupName {
+			remoteBackup = &backupList[i]
+		}
+	}
+	if remoteBackup == nil {
+		err := fmt.Errorf("backup '%s' not found on storage '%s'", backupName, storageName)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if remoteBackup.Encrypted && tool.config.Encryption.SecretKey == "" {
+		err := fmt.Errorf("backup '%s' is encrypted, but encryption secret key is not defined", backupName)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if matchesLocalCopy(srcPath, remoteBackup, storageObj) {
+		fmt.Printf("Use local copy of backup '%s'\n", backupName)
+		return tool.archiver.Unarchive(srcPath, dstPath)
+	}
+	if streamer, ok := storage.Unwrap(storageObj).(storage.Streamer); ok && !remoteBackup.Encrypted {
+		fmt.Print("Extract backup from storage...")
+		reader, err := streamer.DownloadStream(backupName)
+		if err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+		defer func(reader io.ReadCloser) {
+			if err := reader.Close(); err != nil {
+				log.Errorf("%+v", err)
+			}
+		}(reader)
+		extractProgress := progress.Start("extract", remoteBackup.Size)
+		err = tool.archiver.UnarchiveStream(extractProgress.Reader(reader), backupName, dstPath)
+		extractProgress.Finish()
+		if err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+		return nil
+	}
+	tmpDir, err := os.MkdirTemp(tool.paths.base, "restore-")
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer removeAll(tmpDir)
+	if err := storageObj.Download(path.Join(tmpDir, backupName), backupName); err != nil {
+		return err
+	}
+	return tool.archiver.Unarchive(path.Join(tmpDir, path.Base(srcPath)), dstPath)
+}
+
+// matchesLocalCopy compares the checksum of the local archive with the MD5
+// reported by the storage for plain backups or with the SHA-256 of the plain
+// archive recorded at upload. Without a checksum the backup is downloaded
+// again. The local copy of an encrypted backup is already decrypted and
+// lacks the trailing IV and salt.
+func matchesLocalCopy(srcPath string, remoteBackup *storage.BackupInfo, storageObj storage.Interface) bool {
+	fileStat, err := os.Stat(srcPath)
+	if err != nil || remoteBackup.Volumes > 1 {
+		return false
+	}
+	size := remoteBackup.Size
+	if remoteBackup.Encrypted {
+		size -= encryptor.Overhead
+	}
+	if fileStat.Size() != size {
+		return false
+	}
+	if !remoteBackup.Encrypted && remoteBackup.MD5 != "" {
+		checksum, err := helper.FileMD5(srcPath)
+		return err == nil && checksum == remoteBackup.MD5
+	}
+	checksummed, ok := storage.Unwrap(storageObj).(storage.Checksummed)
+	if !ok {
+		return false
+	}
+	remoteChecksum, err := checksummed.Checksum(remoteBackup.Name)
+	if err != nil || remoteChecksum == "" {
+		return false
+	}
+	checksum, err := helper.FileSHA256(srcPath)
+	return err == nil && checksum == remoteChecksum
+}
+
+func removeAll(dirPath string) {
+	if err := os.RemoveAll(dirPath); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package restore
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/pkg/encryptor"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeStorage is a storage without checksums, checksummedStorage reports the
+// checksums of its backups.
+type fakeStorage struct {
+	storage.Interface
+	checksums map[string]string
+}
+
+type checksummedStorage struct {
+	fakeStorage
+}
+
+func (s *checksummedStorage) SetChecksum(string) {}
+
+func (s *checksummedStorage) Checksum(backupName string) (string, error) {
+	return s.checksums[backupName], nil
+}
+
+func TestMatchesLocalCopy(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "db_2024-01-02T03-04-05.tar.lz4")
+	if err := os.WriteFile(srcPath, []byte("backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md5, err := helper.FileMD5(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256, err := helper.FileSHA256(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(srcPath)
+	encryptedName := name + encryptor.Extension
+	checksummed := &checksummedStorage{fakeStorage{checksums: map[string]string{
+		name:          sha256,
+		encryptedName: sha256,
+		"other":       "0123",
+	}}}
+	tests := []struct {
+		name    string
+		backup  storage.BackupInfo
+		storage storage.Interface
+		matches bool
+	}{
+		{name: "same md5", backup: storage.BackupInfo{Name: "plain", Size: 6, MD5: md5}, storage: &fakeStorage{}, matches: true},
+		{name: "other md5", backup: storage.BackupInfo{Name: "plain", Size: 6, MD5: "0123"}, storage: &fakeStorage{}},
+		{name: "other size", backup: storage.BackupInfo{Name: name, Size: 7}, storage: checksummed},
+		{name: "same checksum", backup: storage.BackupInfo{Name: name, Size: 6}, storage: checksummed, matches: true},
+		{name: "other checksum", backup: storage.BackupInfo{Name: "other", Size: 6}, storage: checksummed},
+		{name: "no checksum", backup: storage.BackupInfo{Name: "missing", Size: 6}, storage: checksummed},
+		{name: "storage without checksums", backup: storage.BackupInfo{Name: name, Size: 6}, storage: &fakeStorage{}},
+		{
+			name:    "encrypted with the checksum of the plain backup",
+			backup:  storage.BackupInfo{Name: encryptedName, Size: 6 + encryptor.Overhead, Encrypted: true},
+			storage: storage.NewEncrypted(checksummed, nil),
+			matches: true,
+		},
+		{
+			name:    "encrypted ignores the md5 of the encrypted object",
+			backup:  storage.BackupInfo{Name: encryptedName, Size: 6 + encryptor.Overhead, Encrypted: true, MD5: md5},
+			storage: &fakeStorage{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.backup.Volumes = 1
+			if matchesLocalCopy(srcPath, &test.backup, test.storage) != test.matches {
+				t.Fatalf("expected the local copy to match: %v", test.matches)
+			}
+		})
+	}
+}
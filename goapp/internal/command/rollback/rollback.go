@@ -0,0 +1,107 @@
+package rollback
+
+import (
+	"clickhouse-tools/internal/command/restore"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Result describes the rollback in the json output.
+type Result struct {
+	Database     string `json:"database"`
+	SafetyBackup string `json:"safety_backup"`
+	Cluster      string `json:"cluster,omitempty"`
+}
+
+type Tool struct {
+	config      *config.Application
+	command     *cli.Command
+	clickhouse  *clickhouse.Client
+	restoreTool *restore.Tool
+}
+
+func New(cliApp *cli.App, conf *config.Application, clickhouseClient *clickhouse.Client, restoreTool *restore.Tool) *Tool {
+	return &Tool{
+		config:      conf,
+		clickhouse:  clickhouseClient,
+		restoreTool: restoreTool,
+		command: &cli.Command{
+			Name:        "rollback",
+			Usage:       "Bring back the database kept by restore --safety-backup",
+			UsageText:   "clickhouse-tools rollback [-c, --cluster=<cluster>] [-db, --database=<database>] [-y, --yes] [<snapshot_database>|<backup_name>]",
+			Description: "Replace the database by its snapshot database, the newest one by default, or by the local safety backup",
+			Flags: append(cliApp.Flags,
+				&cli.StringFlag{
+					Name:     "cluster",
+					Aliases:  []string{"c"},
+					Hidden:   false,
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "database",
+					Aliases:  []string{"db"},
+					Hidden:   false,
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Drop the existing non-empty database without confirmation",
+				},
+			),
+		},
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		return tool.rollback(c, c.Args().First(), c.String("cluster"), c.String("database"))
+	}
+	return tool.command
+}
+
+func (tool *Tool) rollback(c *cli.Context, safetyBackup, cluster, database string) error {
+	if err := tool.clickhouse.Connect(""); err != nil {
+		return err
+	}
+	defer tool.clickhouse.CloseConnection()
+	clusters, err := tool.clickhouse.GetClusters()
+	if err != nil {
+		return err
+	}
+	inCluster := len(clusters) > 0
+	if safetyBackup == "" {
+		snapshots, err := tool.clickhouse.GetSnapshots(database)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			err := fmt.Errorf("no snapshot databases of '%s' found", database)
+			log.Errorf("%+v", err)
+			return err
+		}
+		safetyBackup = snapshots[0]
+	}
+	result := &Result{Database: database, SafetyBackup: safetyBackup}
+	if inCluster {
+		result.Cluster = cluster
+	}
+	output.SetResult(result)
+	count, err := tool.clickhouse.CountTables(database)
+	if err != nil {
+		return err
+	}
+	if err := tool.restoreTool.ConfirmDrop(database, count, c.Bool("yes")); err != nil {
+		return err
+	}
+	fmt.Printf("Starting rollback of '%s' to '%s'!\n", database, safetyBackup)
+	if err := tool.restoreTool.Rollback(safetyBackup, database, cluster, inCluster); err != nil {
+		return err
+	}
+	fmt.Println("Successful finish rollback!")
+	return nil
+}
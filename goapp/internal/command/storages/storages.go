@@ -0,0 +1,100 @@
+package storages
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/internal/service/storage/azblob"
+	"clickhouse-tools/internal/service/storage/gcs"
+	"clickhouse-tools/internal/service/storage/local"
+	"clickhouse-tools/internal/service/storage/rsync"
+	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/internal/service/storage/sftp"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"sort"
+)
+
+// Result lists the storages in the json output.
+type Result struct {
+	Storages []StorageResult `json:"storages"`
+}
+
+type StorageResult struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Location  string `json:"location"`
+	Profile   bool   `json:"profile"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+type Tool struct {
+	config  *config.Application
+	command *cli.Command
+}
+
+func New(cliApp *cli.App, conf *config.Application) *Tool {
+	return &Tool{
+		config: conf,
+		command: &cli.Command{
+			Name:        "storages",
+			Usage:       "Show configured storages",
+			UsageText:   "clickhouse-tools storages",
+			Description: "Show named storage profiles and default storages",
+			Flags:       cliApp.Flags,
+		},
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		tool.printStorages()
+		return nil
+	}
+	return tool.command
+}
+
+func (tool *Tool) printStorages() {
+	result := &Result{Storages: []StorageResult{}}
+	output.SetResult(result)
+	var names []string
+	for name := range tool.config.Storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("Storage profiles:")
+	if len(names) == 0 {
+		fmt.Println("no storage profiles found")
+	}
+	for _, name := range names {
+		tool.printStorage(tool.config.Storages[name])
+		result.Storages = append(result.Storages, tool.storageResult(tool.config.Storages[name], true))
+	}
+	fmt.Println("Default storages:")
+	for _, storageType := range []string{rsync.Name, sftp.Name, local.Name, s3.Name, gcs.Name, azblob.Name} {
+		if _, ok := tool.config.Storages[storageType]; ok {
+			continue
+		}
+		tool.printStorage(tool.config.DefaultStorageProfile(storageType))
+		result.Storages = append(result.Storages, tool.storageResult(tool.config.DefaultStorageProfile(storageType), false))
+	}
+}
+
+func (tool *Tool) storageResult(profile *config.StorageProfile, isProfile bool) StorageResult {
+	return StorageResult{
+		Name:      profile.Name,
+		Type:      profile.Type,
+		Location:  storage.Describe(profile),
+		Profile:   isProfile,
+		Encrypted: tool.config.Encryption.SecretKey != "",
+	}
+}
+
+func (tool *Tool) printStorage(profile *config.StorageProfile) {
+	fmt.Printf("- '%s'\t%s\t%s", profile.Name, profile.Type, storage.Describe(profile))
+	if tool.config.Encryption.SecretKey != "" {
+		helper.ColoredPrint(helper.ColorYellow, "\tencrypted")
+	}
+	fmt.Println()
+}
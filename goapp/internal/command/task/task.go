@@ -2,31 +2,69 @@ package task
 
 import (
 	"clickhouse-tools/internal/command/backup"
-	"clickhouse-tools/internal/command/upload"
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/pkg/encryptor"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	policyAll = "all"
+	policyAny = "any"
 )
 
 type Tool struct {
+	config     *config.Application
 	backupTool *backup.Tool
-	uploadTool *upload.Upload
 	command    *cli.Command
 }
 
-func New(cliApp *cli.App, backupTool *backup.Tool, uploadTool *upload.Upload) *Tool {
+type uploadResult struct {
+	storageName string
+	err         error
+	duration    time.Duration
+}
+
+// Result describes the task in the json output.
+type Result struct {
+	Backup        *backup.Result  `json:"backup,omitempty"`
+	SuccessPolicy string          `json:"success_policy"`
+	Storages      []StorageResult `json:"storages"`
+}
+
+type StorageResult struct {
+	Storage         string  `json:"storage"`
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+func New(cliApp *cli.App, conf *config.Application, backupTool *backup.Tool) *Tool {
 	return &Tool{
+		config:     conf,
 		backupTool: backupTool,
-		uploadTool: uploadTool,
 		command: &cli.Command{
 			Name:        "task",
 			Usage:       "Run backup task",
-			UsageText:   "clickhouse-tools task [-s, --storage=<storage>] [-db, --database=<database>]",
-			Description: "Create new backup and upload it",
+			UsageText:   "clickhouse-tools task [-s, --storage=<storage>]... [-db, --database=<database>] [--success-policy=(all|any)]",
+			Description: "Create new backup and upload it to every storage in parallel",
 			Flags: append(cliApp.Flags,
-				&cli.StringFlag{
-					Name:     "storage",
-					Aliases:  []string{"s"},
-					Hidden:   false,
-					Required: true,
+				&cli.StringSliceFlag{
+					Name:    "storage",
+					Aliases: []string{"s"},
+					Usage:   "Storage to upload the backup to, may be repeated (default TASK_STORAGES)",
+					Hidden:  false,
 				},
 				&cli.StringFlag{
 					Name:     "database",
@@ -34,6 +72,10 @@ func New(cliApp *cli.App, backupTool *backup.Tool, uploadTool *upload.Upload) *T
 					Hidden:   false,
 					Required: true,
 				},
+				&cli.StringFlag{
+					Name:  "success-policy",
+					Usage: "'all' fails the task when any upload fails, 'any' when every upload fails (default TASK_SUCCESS_POLICY)",
+				},
 			),
 		},
 	}
@@ -47,11 +89,139 @@ func (tool *Tool) GetCommand() *cli.Command {
 }
 
 func (tool *Tool) runTask(c *cli.Context) error {
+	storageNames := c.StringSlice("storage")
+	if len(storageNames) == 0 {
+		storageNames = tool.config.Task.Storages
+	}
+	if len(storageNames) == 0 {
+		return output.UsageError(c, errors.New("at least one storage must be defined"))
+	}
+	successPolicy := c.String("success-policy")
+	if successPolicy == "" {
+		successPolicy = tool.config.Task.SuccessPolicy
+	}
+	if successPolicy != policyAll && successPolicy != policyAny {
+		err := fmt.Errorf("unsupported success policy '%s'", successPolicy)
+		log.Errorf("%+v", err)
+		return err
+	}
+	storages := make(map[string]storage.Interface, len(storageNames))
+	for _, storageName := range storageNames {
+		storageObj, err := storage.InitStorage(tool.config, storageName)
+		if err != nil {
+			return err
+		}
+		// The backup is encrypted once below instead of by every storage.
+		storages[storageName] = storage.Unwrap(storageObj)
+	}
 	if err := tool.backupTool.Backup(c.String("database")); err != nil {
 		return err
 	}
-	if err := tool.uploadTool.Upload(c, tool.backupTool.GetArchiveName(), c.String("storage")); err != nil {
+	result := &Result{
+		Backup:        tool.backupTool.Result(c.String("database")),
+		SuccessPolicy: successPolicy,
+	}
+	output.SetResult(result)
+	archivePath := path.Join(clickhouse.DefaultDataPath, "backup", tool.backupTool.GetArchiveName())
+	src, err := tool.prepareUpload(archivePath)
+	if err != nil {
 		return err
 	}
+	if src != archivePath {
+		defer func(src string) {
+			if err := os.Remove(src); err != nil {
+				log.Errorf("%+v", err)
+			}
+		}(src)
+		if err := setChecksum(archivePath, storages); err != nil {
+			return err
+		}
+	}
+	results := tool.upload(src, storageNames, storages)
+	for _, uploaded := range results {
+		storageResult := StorageResult{
+			Storage:         uploaded.storageName,
+			Success:         uploaded.err == nil,
+			DurationSeconds: uploaded.duration.Seconds(),
+		}
+		if uploaded.err != nil {
+			storageResult.Error = uploaded.err.Error()
+		}
+		result.Storages = append(result.Storages, storageResult)
+	}
+	return checkResults(results, successPolicy)
+}
+
+func (tool *Tool) prepareUpload(src string) (string, error) {
+	if tool.config.Encryption.SecretKey == "" {
+		return src, nil
+	}
+	fmt.Print("Encrypt backup...")
+	encSrc, err := encryptor.New(tool.config.Encryption).EncryptFile(src)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return "", err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return encSrc, nil
+}
+
+// setChecksum passes the checksum of the plain archive to the checksummed
+// storages, they can't compute it from the encrypted one.
+func setChecksum(archivePath string, storages map[string]storage.Interface) error {
+	checksum, err := helper.FileSHA256(archivePath)
+	if err != nil {
+		return err
+	}
+	for _, storageObj := range storages {
+		if checksummed, ok := storageObj.(storage.Checksummed); ok {
+			checksummed.SetChecksum(checksum)
+		}
+	}
 	return nil
 }
+
+func (tool *Tool) upload(src string, storageNames []string, storages map[string]storage.Interface) []uploadResult {
+	fmt.Printf("Starting upload backup to %s!\n", strings.Join(storageNames, ", "))
+	results := make([]uploadResult, len(storageNames))
+	var wg sync.WaitGroup
+	for i, storageName := range storageNames {
+		wg.Add(1)
+		go func(i int, storageName string) {
+			defer wg.Done()
+			started := time.Now()
+			err := storages[storageName].Upload(src)
+			results[i] = uploadResult{
+				storageName: storageName,
+				err:         err,
+				duration:    time.Since(started),
+			}
+		}(i, storageName)
+	}
+	wg.Wait()
+	return results
+}
+
+func checkResults(results []uploadResult, successPolicy string) error {
+	var failed []string
+	fmt.Println("Upload results:")
+	for _, result := range results {
+		fmt.Printf("  %s: ", result.storageName)
+		if result.err != nil {
+			failed = append(failed, result.storageName)
+			helper.ColoredPrintln(helper.ColorRed, fmt.Sprintf("error! %v", result.err))
+			continue
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+	}
+	if len(failed) == 0 || (successPolicy == policyAny && len(failed) < len(results)) {
+		if len(failed) > 0 {
+			log.Warnf("backup is not uploaded to %s", strings.Join(failed, ", "))
+		}
+		fmt.Println("Successful finish task!")
+		return nil
+	}
+	err := fmt.Errorf("backup upload failed to %d of %d storages: %s", len(failed), len(results), strings.Join(failed, ", "))
+	log.Errorf("%+v", err)
+	return err
+}
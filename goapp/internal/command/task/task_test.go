@@ -0,0 +1,213 @@
+package task
+
+import (
+	"bytes"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/storage"
+	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/pkg/encryptor"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal path-style S3 API with multipart uploads. Parts of an
+// aborted upload are refused like S3 does.
+type fakeS3 struct {
+	mu      sync.Mutex
+	uploads map[string]map[int][]byte
+	objects map[string][]byte
+	// checksums are the checksums in the metadata of the uploads.
+	checksums map[string]string
+	aborted   int
+	nextId    int
+	// holdBucket holds the first part uploaded to this bucket until release
+	// is closed, holding is closed when the part arrives.
+	holdBucket       string
+	holdOnce         sync.Once
+	holding, release chan struct{}
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{uploads: map[string]map[int][]byte{}, objects: map[string][]byte{}, checksums: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fake *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if fake.holdBucket != "" && strings.HasPrefix(r.URL.Path, "/"+fake.holdBucket+"/") && query.Has("partNumber") {
+		fake.holdOnce.Do(func() {
+			close(fake.holding)
+			<-fake.release
+		})
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	uploadId := query.Get("uploadId")
+	parts := fake.uploads[uploadId]
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.nextId++
+		uploadId = strconv.Itoa(fake.nextId)
+		fake.uploads[uploadId] = map[int][]byte{}
+		fake.checksums[r.URL.Path] = r.Header.Get("X-Amz-Meta-Sha256")
+		_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadId)
+	case uploadId != "" && parts == nil:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, "<Error><Code>NoSuchUpload</Code><Message>upload is aborted</Message></Error>")
+	case r.Method == http.MethodPut && uploadId != "":
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodPost && uploadId != "":
+		var numbers []int
+		for partNumber := range parts {
+			numbers = append(numbers, partNumber)
+		}
+		sort.Ints(numbers)
+		var content []byte
+		for _, partNumber := range numbers {
+			content = append(content, parts[partNumber]...)
+		}
+		fake.objects[r.URL.Path] = content
+		delete(fake.uploads, uploadId)
+		_, _ = fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && uploadId != "":
+		fake.aborted++
+		delete(fake.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newS3Profile(name, endpoint, bucket string) *config.StorageProfile {
+	keys := &s3.Keys{AccessKey: "access", SecretKey: "secret"}
+	return &config.StorageProfile{
+		Name: name,
+		Type: s3.Name,
+		S3: &s3.Config{
+			Write:          keys,
+			Read:           keys,
+			Bucket:         bucket,
+			Directory:      "Backup",
+			Endpoint:       endpoint,
+			Region:         "us-east-1",
+			ForcePathStyle: true,
+			Concurrency:    2,
+		},
+	}
+}
+
+func initS3Storages(t *testing.T, endpoint string, storageNames []string) (*config.Application, map[string]storage.Interface) {
+	conf := &config.Application{
+		Encryption: &encryptor.Config{AllowPlaintext: true},
+		Throttle:   &config.Throttle{},
+		Storages: map[string]*config.StorageProfile{
+			"s3-first":  newS3Profile("s3-first", endpoint, "first"),
+			"s3-second": newS3Profile("s3-second", endpoint, "second"),
+		},
+	}
+	storages := map[string]storage.Interface{}
+	for _, storageName := range storageNames {
+		storageObj, err := storage.InitStorage(conf, storageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages[storageName] = storageObj
+	}
+	return conf, storages
+}
+
+// writeBackup writes a backup of two parts of the minimal size.
+func writeBackup(t *testing.T) (string, []byte) {
+	content := make([]byte, 5<<20+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "db_2024-01-02T03-04-05.tar.lz4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return src, content
+}
+
+func assertUploaded(t *testing.T, fake *fakeS3, src string, content []byte) {
+	if fake.aborted != 0 {
+		t.Fatalf("%d uploads are aborted", fake.aborted)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+	for _, bucket := range []string{"first", "second"} {
+		key := "/" + bucket + "/Backup/" + filepath.Base(src)
+		if !bytes.Equal(fake.objects[key], content) {
+			t.Fatalf("backup in bucket %s differs from the local one", bucket)
+		}
+		if fake.checksums[key] != checksum {
+			t.Fatalf("unexpected checksum %q of the backup in bucket %s", fake.checksums[key], bucket)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), s3.StateExtension) {
+			t.Fatalf("upload state %s is left", entry.Name())
+		}
+	}
+}
+
+func TestUploadToSeveralS3Storages(t *testing.T) {
+	fake, server := newFakeS3(t)
+	storageNames := []string{"s3-first", "s3-second"}
+	conf, storages := initS3Storages(t, server.URL, storageNames)
+	src, content := writeBackup(t)
+	tool := &Tool{config: conf}
+	for _, result := range tool.upload(src, storageNames, storages) {
+		if result.err != nil {
+			t.Fatalf("upload to %s failed: %v", result.storageName, result.err)
+		}
+	}
+	assertUploaded(t, fake, src, content)
+}
+
+// TestOverlappingS3Uploads starts the second upload after the first one has
+// saved its state, as the parallel uploads of a task may run.
+func TestOverlappingS3Uploads(t *testing.T) {
+	fake, server := newFakeS3(t)
+	fake.holdBucket, fake.holding, fake.release = "first", make(chan struct{}), make(chan struct{})
+	_, storages := initS3Storages(t, server.URL, []string{"s3-first", "s3-second"})
+	src, content := writeBackup(t)
+	firstErr := make(chan error)
+	go func() {
+		firstErr <- storages["s3-first"].Upload(src)
+	}()
+	<-fake.holding
+	secondErr := storages["s3-second"].Upload(src)
+	close(fake.release)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("upload to s3-first failed: %v", err)
+	}
+	if secondErr != nil {
+		t.Fatalf("upload to s3-second failed: %v", secondErr)
+	}
+	assertUploaded(t, fake, src, content)
+}
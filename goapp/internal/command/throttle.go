@@ -0,0 +1,90 @@
+package command
+
+import (
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/pkg/throttle"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func throttleFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "read-limit",
+			Usage:    "limit reading of data files while archiving, bytes per second, e.g. 50M",
+			Hidden:   false,
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "upload-limit",
+			Usage:    "limit uploads of s3 and rsync storages, bytes per second, e.g. 10M",
+			Hidden:   false,
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "download-limit",
+			Usage:    "limit downloads of s3 and rsync storages, bytes per second, e.g. 10M",
+			Hidden:   false,
+			Required: false,
+		},
+		&cli.IntFlag{
+			Name:     "nice",
+			Usage:    "CPU priority of the process, from -20 (highest) to 19",
+			Hidden:   false,
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "ionice",
+			Usage:    "I/O priority of the process: idle, best-effort[:0-7] or realtime[:0-7]",
+			Hidden:   false,
+			Required: false,
+		},
+	}
+}
+
+// applyThrottle overrides the configured limits by the command flags and sets
+// the process priority before the command runs.
+func applyThrottle(conf *config.Application) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		rates := map[string]*int64{
+			"read-limit":     &conf.Archiver.ReadLimit,
+			"upload-limit":   &conf.Throttle.UploadLimit,
+			"download-limit": &conf.Throttle.DownloadLimit,
+		}
+		for name, rate := range rates {
+			if !c.IsSet(name) {
+				continue
+			}
+			value, err := throttle.ParseRate(c.String(name))
+			if err != nil {
+				log.Errorf("%+v", err)
+				return err
+			}
+			*rate = value
+		}
+		if c.IsSet("nice") {
+			conf.Throttle.Nice = c.Int("nice")
+		}
+		if c.IsSet("ionice") {
+			conf.Throttle.IONice = c.String("ionice")
+		}
+		if conf.Throttle.Nice != 0 {
+			if err := throttle.SetNice(conf.Throttle.Nice); err != nil {
+				log.Errorf("%+v", err)
+				return err
+			}
+		}
+		if conf.Throttle.IONice != "" {
+			priority, err := throttle.ParseIOPriority(conf.Throttle.IONice)
+			if err != nil {
+				log.Errorf("%+v", err)
+				return err
+			}
+			if err := throttle.SetIOPriority(priority); err != nil {
+				log.Errorf("%+v", err)
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,209 @@
+package transfer
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/storage"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"io"
+	"time"
+)
+
+// Result describes the copied backups in the json output.
+type Result struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Backups []BackupResult `json:"backups"`
+}
+
+type BackupResult struct {
+	Name            string  `json:"name"`
+	Size            int64   `json:"size"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+const (
+	statusCopied  = "copied"
+	statusSkipped = "skipped"
+	statusFailed  = "failed"
+)
+
+type Tool struct {
+	config  *config.Application
+	command *cli.Command
+}
+
+func New(cliApp *cli.App, conf *config.Application) *Tool {
+	return &Tool{
+		config: conf,
+		command: &cli.Command{
+			Name:        "copy",
+			Usage:       "Copy backups between remote storages",
+			UsageText:   "clickhouse-tools copy --from=<storage> --to=<storage> (<backup_name>|--all)",
+			Description: "Copy backups between remote storages, skipping backups already present on the destination with the same size and checksum",
+			Flags: append(cliApp.Flags,
+				&cli.StringFlag{
+					Name:     "from",
+					Usage:    "Source storage",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "to",
+					Usage:    "Destination storage",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Copy every backup of the source storage",
+				},
+			),
+		},
+	}
+}
+
+func (tool *Tool) GetCommand() *cli.Command {
+	tool.command.Action = func(c *cli.Context) error {
+		return tool.copy(c, c.Args().First(), c.String("from"), c.String("to"), c.Bool("all"))
+	}
+	return tool.command
+}
+
+func (tool *Tool) copy(c *cli.Context, backupName, fromName, toName string, all bool) error {
+	if backupName == "" && !all || backupName != "" && all {
+		return output.UsageError(c, errors.New("either backup name or --all must be defined"))
+	}
+	// Backups are copied as stored, encrypted ones stay encrypted.
+	from, err := storage.InitStorage(tool.config, fromName)
+	if err != nil {
+		return err
+	}
+	to, err := storage.InitStorage(tool.config, toName)
+	if err != nil {
+		return err
+	}
+	from, to = storage.Unwrap(from), storage.Unwrap(to)
+	for storageName, storageObj := range map[string]storage.Interface{fromName: from, toName: to} {
+		if _, ok := storageObj.(storage.Streamer); !ok {
+			err := fmt.Errorf("storage '%s' can't stream backups, copy them with download and upload instead", storageName)
+			log.Errorf("%+v", err)
+			return err
+		}
+	}
+	sourceList, err := from.List()
+	if err != nil {
+		return err
+	}
+	destinationList, err := to.List()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]storage.BackupInfo, len(destinationList))
+	for _, backup := range destinationList {
+		existing[backup.Name] = backup
+	}
+	var backups []storage.BackupInfo
+	for _, backup := range sourceList {
+		if all || backup.Name == backupName {
+			backups = append(backups, backup)
+		}
+	}
+	if len(backups) == 0 {
+		err := fmt.Errorf("backup '%s' not found on storage '%s'", backupName, fromName)
+		if all {
+			err = fmt.Errorf("no backups found on storage '%s'", fromName)
+		}
+		log.Errorf("%+v", err)
+		return err
+	}
+	fmt.Printf("Starting copy %d backups from %s to %s!\n", len(backups), fromName, toName)
+	result := &Result{From: fromName, To: toName, Backups: []BackupResult{}}
+	output.SetResult(result)
+	var failed, skipped int
+	for _, backup := range backups {
+		backupResult := BackupResult{Name: backup.Name, Size: backup.Size, Status: statusCopied}
+		started := time.Now()
+		if copied, ok := existing[backup.Name]; ok && sameBackup(from, to, backup, copied) {
+			fmt.Printf("Skip '%s'...", backup.Name)
+			helper.ColoredPrintln(helper.ColorYellow, "already exists!")
+			skipped++
+			backupResult.Status = statusSkipped
+			result.Backups = append(result.Backups, backupResult)
+			continue
+		}
+		var err error
+		if backup.Volumes > 1 {
+			err = fmt.Errorf("can't copy '%s': backups of %d volumes are not supported", backup.Name, backup.Volumes)
+			log.Errorf("%+v", err)
+		} else {
+			fmt.Printf("Copy '%s' (%s)\n", backup.Name, helper.FormatBytes(backup.Size))
+			err = copyBackup(from, to, backup)
+		}
+		backupResult.DurationSeconds = time.Since(started).Seconds()
+		if err != nil {
+			failed++
+			backupResult.Status = statusFailed
+			backupResult.Error = err.Error()
+		}
+		result.Backups = append(result.Backups, backupResult)
+	}
+	if failed > 0 {
+		err := fmt.Errorf("can't copy %d of %d backups", failed, len(backups))
+		log.Errorf("%+v", err)
+		return err
+	}
+	fmt.Printf("Successful finish copy backups (%d skipped)!\n", skipped)
+	return nil
+}
+
+// sameBackup compares the backups by size and by the checksums known on both
+// storages, the SHA-256 of the metadata first and the MD5 of the listing then.
+func sameBackup(from, to storage.Interface, backup, copied storage.BackupInfo) bool {
+	if backup.Size != copied.Size {
+		return false
+	}
+	if fromChecksum, toChecksum := checksum(from, backup.Name), checksum(to, copied.Name); fromChecksum != "" && toChecksum != "" {
+		return fromChecksum == toChecksum
+	}
+	if backup.MD5 != "" && copied.MD5 != "" {
+		return backup.MD5 == copied.MD5
+	}
+	return true
+}
+
+// checksum is the SHA-256 kept by a checksummed storage, empty when unknown.
+func checksum(storageObj storage.Interface, backupName string) string {
+	checksummed, ok := storageObj.(storage.Checksummed)
+	if !ok {
+		return ""
+	}
+	checksum, err := checksummed.Checksum(backupName)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return ""
+	}
+	return checksum
+}
+
+// copyBackup streams the backup without a local copy and keeps its checksum
+// on the destination.
+func copyBackup(from, to storage.Interface, backup storage.BackupInfo) error {
+	reader, err := from.(storage.Streamer).DownloadStream(backup.Name)
+	if err != nil {
+		return err
+	}
+	if checksummed, ok := to.(storage.Checksummed); ok {
+		checksummed.SetChecksum(checksum(from, backup.Name))
+	}
+	defer func(reader io.ReadCloser) {
+		if err := reader.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(reader)
+	return to.(storage.Streamer).UploadStream(backup.Name, reader, backup.Size)
+}
@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"clickhouse-tools/internal/service/storage"
+	"testing"
+)
+
+// fakeStorage is a storage without checksums, checksummedStorage reports the
+// checksums of its backups.
+type fakeStorage struct {
+	storage.Interface
+	checksums map[string]string
+}
+
+type checksummedStorage struct {
+	fakeStorage
+}
+
+func (s *checksummedStorage) SetChecksum(string) {}
+
+func (s *checksummedStorage) Checksum(backupName string) (string, error) {
+	return s.checksums[backupName], nil
+}
+
+func TestSameBackup(t *testing.T) {
+	name := "db_2024-01-02T03-04-05.tar.lz4"
+	first := &checksummedStorage{fakeStorage{checksums: map[string]string{name: "0123"}}}
+	second := &checksummedStorage{fakeStorage{checksums: map[string]string{name: "0123"}}}
+	other := &checksummedStorage{fakeStorage{checksums: map[string]string{name: "4567"}}}
+	tests := []struct {
+		name     string
+		from, to storage.Interface
+		copied   storage.BackupInfo
+		same     bool
+	}{
+		{name: "same checksum", from: first, to: second, copied: storage.BackupInfo{Size: 6}, same: true},
+		{name: "other checksum", from: first, to: other, copied: storage.BackupInfo{Size: 6}},
+		{name: "other checksum and same md5", from: first, to: other, copied: storage.BackupInfo{Size: 6, MD5: "abcd"}},
+		{name: "other size", from: first, to: second, copied: storage.BackupInfo{Size: 7}},
+		{name: "same md5", from: &fakeStorage{}, to: second, copied: storage.BackupInfo{Size: 6, MD5: "abcd"}, same: true},
+		{name: "other md5", from: &fakeStorage{}, to: &fakeStorage{}, copied: storage.BackupInfo{Size: 6, MD5: "ef01"}},
+		{name: "size only", from: &fakeStorage{}, to: second, copied: storage.BackupInfo{Size: 6}, same: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backup := storage.BackupInfo{Name: name, Size: 6, MD5: "abcd"}
+			test.copied.Name = name
+			if sameBackup(test.from, test.to, backup, test.copied) != test.same {
+				t.Fatalf("expected the backups to be the same: %v", test.same)
+			}
+		})
+	}
+}
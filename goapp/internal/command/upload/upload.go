@@ -3,11 +3,12 @@ package upload
 import (
 	"clickhouse-tools/internal/service/clickhouse"
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/output"
 	"clickhouse-tools/internal/service/storage"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"os"
 	"path"
 )
 
@@ -15,6 +16,14 @@ const (
 	upload = "upload"
 )
 
+// Result describes the uploaded backup in the json output.
+type Result struct {
+	BackupName string `json:"backup_name"`
+	Storage    string `json:"storage"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+}
+
 type Upload struct {
 	config  *config.Application
 	command *cli.Command
@@ -26,7 +35,7 @@ func New(cliApp *cli.App, conf *config.Application) *Upload {
 		command: &cli.Command{
 			Name:        "upload",
 			Usage:       "Upload backup to remote storage",
-			UsageText:   "clickhouse-tools upload [-s, --storage=<storage>] <backup_name>",
+			UsageText:   "clickhouse-tools upload [-s, --storage=<storage>] [--resume] <backup_name>",
 			Description: "Upload backup to remote storage",
 			Flags: append(cliApp.Flags,
 				&cli.StringFlag{
@@ -35,6 +44,10 @@ func New(cliApp *cli.App, conf *config.Application) *Upload {
 					Hidden:   false,
 					Required: true,
 				},
+				&cli.BoolFlag{
+					Name:  "resume",
+					Usage: "Continue an interrupted transfer",
+				},
 			),
 		},
 	}
@@ -49,15 +62,23 @@ func (tool *Upload) GetCommand() *cli.Command {
 
 func (tool *Upload) Upload(c *cli.Context, backupName, storageName string) error {
 	if backupName == "" {
-		log.Errorf("%+v", errors.New("backup name must be defined"))
-		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+		return output.UsageError(c, errors.New("backup name must be defined"))
 	}
 	fmt.Println("Starting upload backup!")
 	storageObj, err := storage.InitStorage(tool.config, storageName)
 	if err != nil {
 		return err
 	}
-	if err := storageObj.Upload(path.Join(clickhouse.DefaultDataPath, "backup", backupName)); err != nil {
+	if resumable, ok := storageObj.(storage.Resumable); ok {
+		resumable.SetResume(c.Bool("resume"))
+	}
+	src := path.Join(clickhouse.DefaultDataPath, "backup", backupName)
+	result := &Result{BackupName: backupName, Storage: storageName, Path: src}
+	if fileStat, err := os.Stat(src); err == nil {
+		result.Size = fileStat.Size()
+	}
+	output.SetResult(result)
+	if err := storageObj.Upload(src); err != nil {
 		return err
 	}
 	fmt.Println("Successful finish upload backup!")
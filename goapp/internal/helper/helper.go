@@ -1,8 +1,14 @@
 package helper
 
 import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -24,11 +30,23 @@ const (
 	UuidRegExpFile = `([\w\d\D\s]+ReplicatedMergeTree\('/clickhouse/tables/)([\w\d-]+)(/{shard}/[\w\d\D\s]+)`
 )
 
+var colors = true
+
+// DisableColors makes ColoredPrint and ColoredPrintln print plain text.
+func DisableColors() {
+	colors = false
+}
+
 func ColoredPrintln(color string, message string) {
-	fmt.Printf("%s%s%s\n", color, message, ColorReset)
+	ColoredPrint(color, message)
+	fmt.Println()
 }
 
 func ColoredPrint(color string, message string) {
+	if !colors {
+		fmt.Print(message)
+		return
+	}
 	fmt.Printf("%s%s%s", color, message, ColorReset)
 }
 
@@ -161,3 +179,50 @@ func ReadFile(path string) (string, error) {
 	}
 	return strings.TrimSpace(string(content)), nil
 }
+
+func FileMD5(path string) (string, error) {
+	return fileHash(path, md5.New())
+}
+
+func FileSHA256(path string) (string, error) {
+	return fileHash(path, sha256.New())
+}
+
+func fileHash(path string, hash hash.Hash) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Confirm asks a yes/no question on the terminal. Without a terminal on stdin
+// the question can't be answered and an error is returned.
+func Confirm(question string) (bool, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("confirmation required, but stdin is not a terminal")
+	}
+	ColoredPrint(ColorYellow, question+" [y/N]: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Errorf("%+v", err)
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -2,6 +2,7 @@ package clickhouse
 
 import (
 	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/progress"
 	"fmt"
 	clickhouseGo "github.com/ClickHouse/clickhouse-go"
 	"github.com/jmoiron/sqlx"
@@ -80,14 +81,19 @@ func (clickhouse *Client) CloseConnection() {
 
 func (clickhouse *Client) Freeze(database string, tables []Table) error {
 	fmt.Print("Freeze tables...")
+	freezeProgress := progress.Start("freeze", 0)
+	freezeProgress.SetItems(len(tables), progress.UnitTables)
 	for _, table := range tables {
 		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE", database, table.Name)
 		if _, err := clickhouse.Connection.Exec(query); err != nil {
+			freezeProgress.Finish()
 			helper.ColoredPrintln(helper.ColorRed, "error!")
 			log.Errorf("can't freeze partition on '%s.%s': %v", database, table.Name, err)
 			return err
 		}
+		freezeProgress.Done()
 	}
+	freezeProgress.Finish()
 	helper.ColoredPrintln(helper.ColorGreen, "done!")
 	return nil
 }
@@ -104,31 +110,53 @@ func (clickhouse *Client) GetTables(database string) (tables []Table, err error)
 	return tables, nil
 }
 
-func (clickhouse *Client) DropAllData(database, cluster string, inCluster bool) error {
+// CountTables returns the number of tables of the database, zero when it
+// doesn't exist.
+func (clickhouse *Client) CountTables(database string) (int, error) {
+	var count int
+	if err := clickhouse.Connection.Get(&count, "SELECT count() FROM system.tables WHERE database = ?", database); err != nil {
+		log.Errorf("can't count tables of database '%s': %v", database, err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// DropDatabaseQueries returns the queries recreating the database empty.
+func DropDatabaseQueries(database, cluster string, inCluster bool) []string {
 	var onCluster string
-	fmt.Print("Drop all tables\t\t...")
 	if inCluster {
-		onCluster = fmt.Sprintf(" ON CLUSTER %s", cluster)
+		onCluster = fmt.Sprintf("ON CLUSTER %s", cluster)
 	}
-	dropDatabaseQuery := fmt.Sprintf("DROP DATABASE IF EXISTS %s %s SYNC", database, onCluster)
-	if _, err := clickhouse.Connection.Exec(dropDatabaseQuery); err != nil {
-		helper.ColoredPrintln(helper.ColorRed, "error!")
-		log.Errorf("can't drop database '%s': %v", database, err)
-		return err
+	return []string{
+		fmt.Sprintf("DROP DATABASE IF EXISTS %s %s SYNC", database, onCluster),
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s %s", database, onCluster),
 	}
-	createDatabaseQuery := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s %s", database, onCluster)
-	if _, err := clickhouse.Connection.Exec(createDatabaseQuery); err != nil {
-		helper.ColoredPrintln(helper.ColorRed, "error!")
-		log.Errorf("can't create database '%s': %v", database, err)
-		return err
+}
+
+func (clickhouse *Client) DropAllData(database, cluster string, inCluster bool) error {
+	fmt.Print("Drop all tables\t\t...")
+	for _, query := range DropDatabaseQueries(database, cluster, inCluster) {
+		if _, err := clickhouse.Connection.Exec(query); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			log.Errorf("can't recreate database '%s' by '%s': %v", database, query, err)
+			return err
+		}
 	}
 	helper.ColoredPrintln(helper.ColorGreen, "done!")
 	return nil
 }
 
-func (clickhouse *Client) RestoreTablesSchemas(database, metadataPath string, cluster string, inCluster bool) error {
-	var onCluster string
-	fmt.Print("Restore tables schemas\t...")
+// SchemaQuery is a CREATE TABLE query of the backup rewritten for the target
+// database.
+type SchemaQuery struct {
+	File, Query string
+}
+
+func SchemaQueries(database, metadataPath string, cluster string, inCluster bool) ([]SchemaQuery, error) {
+	var (
+		onCluster string
+		queries   []SchemaQuery
+	)
 	if inCluster {
 		onCluster = fmt.Sprintf("ON CLUSTER %s", cluster)
 	}
@@ -148,21 +176,52 @@ func (clickhouse *Client) RestoreTablesSchemas(database, metadataPath string, cl
 		re = regexp.MustCompile(`(?m)/clickhouse/tables/[a-z0-9-]+/{shard}`)
 		substitution = "/clickhouse/tables/{uuid}/{shard}"
 		query = re.ReplaceAllString(query, substitution)
-		if _, err := clickhouse.Connection.Exec(query); err != nil {
-			log.Errorf("can't create table schema from file '%s': %v", filePath, err)
-			return err
-		}
+		queries = append(queries, SchemaQuery{File: filePath, Query: query})
 		return nil
 	}); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+func (clickhouse *Client) RestoreTablesSchemas(database, metadataPath string, cluster string, inCluster bool) error {
+	fmt.Print("Restore tables schemas\t...")
+	queries, err := SchemaQueries(database, metadataPath, cluster, inCluster)
+	if err != nil {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	for _, query := range queries {
+		if _, err := clickhouse.Connection.Exec(query.Query); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			log.Errorf("can't create table schema from file '%s': %v", query.File, err)
+			return err
+		}
+	}
 	helper.ColoredPrintln(helper.ColorGreen, "done!")
 	return nil
 }
 
-func (clickhouse *Client) RestoreTablesData(database, dataPath string) error {
-	fmt.Print("Restore tables data\t...")
+// Move is a file of the backup moved into the detached directory of its table.
+type Move struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// TableData describes how the data of a table is restored: the directories
+// created and the files moved into its detached directory, the parts to
+// attach and the skipped ones.
+type TableData struct {
+	Name        string
+	Directories []string
+	Moves       []Move
+	Parts       []string
+	Skipped     []PartResult
+}
+
+// TablesData plans the restore of the data extracted to dataPath without
+// changing anything.
+func TablesData(database, dataPath string) ([]TableData, error) {
 	databasePath := path.Join(DefaultDataPath, "data", database)
 	var metaPath = strings.Replace(dataPath, "data", "metadata", 1)
 	var tableIdsPath = strings.Replace(dataPath, "data", "tables", 1)
@@ -170,21 +229,23 @@ func (clickhouse *Client) RestoreTablesData(database, dataPath string) error {
 	metaFiles, err := ioutil.ReadDir(metaPath)
 	if err != nil {
 		log.Errorf("%+v", err)
-		return err
+		return nil, err
 	}
-
+	var tables []TableData
 	for _, metaFile := range metaFiles {
 		tableName := strings.TrimSuffix(metaFile.Name(), filepath.Ext(metaFile.Name()))
 		metaTablePath := path.Join(tableIdsPath, strings.Join([]string{tableName, "uuid"}, "."))
 		tableUuid, err := helper.ReadFile(metaTablePath)
 		if err != nil {
 			log.Errorf("%+v", err)
-			return err
+			return nil, err
 		}
 
 		tableDirName := string([]rune(tableUuid)[:3])
 		srcTablePath := path.Join(dataPath, tableDirName, tableUuid)
 		dstTablePath := path.Join(databasePath, tableName, "detached")
+		table := TableData{Name: tableName}
+		var partDirs []string
 
 		if err := filepath.Walk(srcTablePath, func(filePath string, fileInfo os.FileInfo, err error) error {
 			if err != nil {
@@ -197,50 +258,203 @@ func (clickhouse *Client) RestoreTablesData(database, dataPath string) error {
 			relativePath := strings.Trim(strings.TrimPrefix(filePath, srcTablePath), "/")
 			dstPath := path.Join(dstTablePath, relativePath)
 			if fileInfo.IsDir() {
-				if err = os.MkdirAll(dstPath, 0750); err != nil {
-					log.Errorf("%+v", err)
-					return err
-				}
-				if err = clickhouse.Chown(dstPath); err != nil {
-					return err
+				table.Directories = append(table.Directories, dstPath)
+				if !strings.Contains(relativePath, "/") {
+					partDirs = append(partDirs, relativePath)
 				}
 				return nil
 			}
 			if !fileInfo.Mode().IsRegular() {
 				return nil
 			}
-			if err = os.Rename(filePath, dstPath); err != nil {
-				log.Errorf("%+v", err)
-				return err
-			}
-			if err = clickhouse.Chown(dstPath); err != nil {
-				return err
-			}
+			table.Moves = append(table.Moves, Move{Source: filePath, Destination: dstPath})
 			return nil
 		}); err != nil {
-			return err
+			return nil, err
+		}
+		table.Parts, table.Skipped = planParts(tableName, partDirs)
+		skipDetached(&table, dstTablePath)
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// FilterTables keeps the listed tables, all of them when the list is empty.
+func FilterTables(tables []TableData, only []string) []TableData {
+	if len(only) == 0 {
+		return tables
+	}
+	var filtered []TableData
+	for _, table := range tables {
+		for _, name := range only {
+			if table.Name == name {
+				filtered = append(filtered, table)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// skipDetached leaves the skipped parts in the extracted backup, so they
+// don't remain in the detached directory.
+func skipDetached(table *TableData, dstTablePath string) {
+	skipped := map[string]bool{}
+	for _, part := range table.Skipped {
+		skipped[part.Part] = true
+	}
+	partOf := func(dstPath string) string {
+		return strings.SplitN(strings.TrimPrefix(dstPath, dstTablePath+"/"), "/", 2)[0]
+	}
+	var directories []string
+	for _, directory := range table.Directories {
+		if !skipped[partOf(directory)] {
+			directories = append(directories, directory)
+		}
+	}
+	var moves []Move
+	for _, move := range table.Moves {
+		if !skipped[partOf(move.Destination)] {
+			moves = append(moves, move)
+		}
+	}
+	table.Directories, table.Moves = directories, moves
+}
+
+// AttachQuery returns the query attaching the part of the table.
+func AttachQuery(database, table, part string) string {
+	return fmt.Sprintf("ALTER TABLE %s.%s ATTACH PART '%s'", database, table, part)
+}
+
+// MergesQuery returns the query stopping or starting the merges of the table.
+func MergesQuery(database, table string, start bool) string {
+	if start {
+		return fmt.Sprintf("SYSTEM START MERGES %s.%s", database, table)
+	}
+	return fmt.Sprintf("SYSTEM STOP MERGES %s.%s", database, table)
+}
+
+// RestoreReport describes the restored data.
+type RestoreReport struct {
+	Parts      []PartResult `json:"parts,omitempty"`
+	Mismatches []Mismatch   `json:"mismatches,omitempty"`
+}
+
+// RestoreTablesData restores the data extracted to dataPath and validates it
+// against the manifest, only of the listed tables when the list isn't empty.
+// Merges of the tables are stopped until the validation is done, so the
+// parts are compared as attached.
+func (clickhouse *Client) RestoreTablesData(database, dataPath string, manifest *Manifest, only []string) (RestoreReport, error) {
+	var report RestoreReport
+	tables, err := TablesData(database, dataPath)
+	if err != nil {
+		return report, err
+	}
+	tables = FilterTables(tables, only)
+	manifest = manifest.Only(only)
+	for _, table := range tables {
+		if len(table.Parts) == 0 {
+			continue
+		}
+		if _, err := clickhouse.Connection.Exec(MergesQuery(database, table.Name, false)); err != nil {
+			log.Errorf("can't stop merges of table '%s.%s': %v", database, table.Name, err)
+			return report, err
+		}
+		defer func(table string) {
+			if _, err := clickhouse.Connection.Exec(MergesQuery(database, table, true)); err != nil {
+				log.Errorf("can't start merges of table '%s.%s': %v", database, table, err)
+			}
+		}(table.Name)
+	}
+	report.Parts, err = clickhouse.attachTablesData(database, dataPath, tables)
+	if manifest == nil {
+		log.Warn("backup has no manifest, restored data isn't validated")
+		return report, err
+	}
+	mismatches, validateErr := clickhouse.Validate(database, manifest, only)
+	report.Mismatches = mismatches
+	if err == nil {
+		err = validateErr
+	}
+	return report, err
+}
+
+// attachTablesData moves the data extracted to dataPath into the detached
+// directories and attaches it part by part. A part failing to attach doesn't
+// stop the others, the results of all parts are returned and printed.
+func (clickhouse *Client) attachTablesData(database, dataPath string, tables []TableData) ([]PartResult, error) {
+	fmt.Print("Restore tables data\t...")
+	var err error
+	var results []PartResult
+	attachProgress := progress.Start("attach", 0)
+	attachProgress.SetItems(len(tables), progress.UnitTables)
+	defer attachProgress.Finish()
+	for _, table := range tables {
+		if err = clickhouse.moveTableData(table); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return results, err
+		}
+		for _, part := range table.Parts {
+			result := PartResult{Table: table.Name, Part: part, Status: PartAttached}
+			if _, err := clickhouse.Connection.Exec(AttachQuery(database, table.Name, part)); err != nil {
+				log.Errorf("can't attach part '%s' of table '%s.%s': %v", part, database, table.Name, err)
+				result.Status, result.Error = PartFailed, err.Error()
+			}
+			results = append(results, result)
+		}
+		results = append(results, table.Skipped...)
+		attachProgress.Done()
+	}
+	if err = os.RemoveAll(path.Dir(dataPath)); err != nil {
+		log.Errorf("%+v", err)
+		return results, err
+	}
+	attachProgress.Finish()
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	if counts[PartFailed] > 0 {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		err = fmt.Errorf("%d parts failed to attach", counts[PartFailed])
+	} else {
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+	}
+	fmt.Printf("Parts: %d attached, %d skipped, %d failed\n", counts[PartAttached], counts[PartSkipped], counts[PartFailed])
+	for _, result := range results {
+		switch result.Status {
+		case PartSkipped:
+			helper.ColoredPrintln(helper.ColorYellow, fmt.Sprintf("- %s %s skipped: %s", result.Table, result.Part, result.Error))
+		case PartFailed:
+			helper.ColoredPrintln(helper.ColorRed, fmt.Sprintf("- %s %s failed: %s", result.Table, result.Part, result.Error))
 		}
-		backupPath := strings.Replace(dataPath, "data", "", 1)
-		if err = os.RemoveAll(backupPath); err != nil {
+	}
+	if err != nil {
+		log.Errorf("%+v", err)
+	}
+	return results, err
+}
+
+// moveTableData moves the files of the table into its detached directory.
+func (clickhouse *Client) moveTableData(table TableData) error {
+	for _, directory := range table.Directories {
+		if err := os.MkdirAll(directory, 0750); err != nil {
 			log.Errorf("%+v", err)
 			return err
 		}
-		partitionsDirs, err := ioutil.ReadDir(dstTablePath)
-		if err != nil {
+		if err := clickhouse.Chown(directory); err != nil {
+			return err
+		}
+	}
+	for _, move := range table.Moves {
+		if err := os.Rename(move.Source, move.Destination); err != nil {
 			log.Errorf("%+v", err)
 			return err
 		}
-		for _, partitionDir := range partitionsDirs {
-			re := regexp.MustCompile(`(?m)(\d+)([_\d]+)`)
-			partition := re.ReplaceAllString(partitionDir.Name(), "$1")
-			query := fmt.Sprintf("ALTER TABLE %s.%s ATTACH PARTITION %s", database, tableName, partition)
-			if _, err := clickhouse.Connection.Exec(query); err != nil {
-				log.Errorf("%+v", err)
-				return err
-			}
+		if err := clickhouse.Chown(move.Destination); err != nil {
+			return err
 		}
 	}
-	helper.ColoredPrintln(helper.ColorGreen, "done!")
 	return nil
 }
 
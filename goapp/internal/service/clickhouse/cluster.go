@@ -0,0 +1,154 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ClusterManifestExtension = ".cluster.json"
+)
+
+// Replica is a host of a cluster from system.clusters.
+type Replica struct {
+	Shard   uint32 `db:"shard_num" json:"shard"`
+	Replica uint32 `db:"replica_num" json:"replica"`
+	Host    string `db:"host_name" json:"host"`
+	Port    uint16 `db:"port" json:"port"`
+	IsLocal uint8  `db:"is_local" json:"-"`
+	Errors  uint32 `db:"errors_count" json:"-"`
+}
+
+// ClusterManifest describes a cluster backup: one archive per shard, each
+// created on one replica of the shard from the same freeze.
+type ClusterManifest struct {
+	Cluster   string         `json:"cluster"`
+	Database  string         `json:"database"`
+	CreatedAt time.Time      `json:"created_at"`
+	Shards    []ClusterShard `json:"shards"`
+}
+
+type ClusterShard struct {
+	Replica
+	Backup string `json:"backup"`
+	Size   int64  `json:"size"`
+}
+
+func IsClusterManifest(backupName string) bool {
+	return strings.HasSuffix(backupName, ClusterManifestExtension)
+}
+
+func (manifest *ClusterManifest) Save(manifestPath string) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err := os.WriteFile(manifestPath, content, 0640); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadClusterManifest(manifestPath string) (*ClusterManifest, error) {
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	var manifest ClusterManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		log.Errorf("can't read cluster manifest '%s': %v", manifestPath, err)
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (clickhouse *Client) GetReplicas(cluster string) ([]Replica, error) {
+	var replicas []Replica
+	if err := clickhouse.Connection.Select(&replicas, "SELECT shard_num, replica_num, host_name, port, is_local, errors_count FROM system.clusters WHERE cluster = ? ORDER BY shard_num, replica_num", cluster); err != nil {
+		log.Errorf("can't get replicas of cluster '%s': %v", cluster, err)
+		return nil, err
+	}
+	if len(replicas) == 0 {
+		err := fmt.Errorf("cluster '%s' not found", cluster)
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return replicas, nil
+}
+
+// ForReplica returns a client of the replica with the same credentials.
+func (clickhouse *Client) ForReplica(replica Replica) *Client {
+	return New(&Config{
+		Host:     replica.Host,
+		Port:     int(replica.Port),
+		Username: clickhouse.Config.Username,
+		Password: clickhouse.Config.Password,
+	})
+}
+
+// HealthyReplicas picks one replica per shard answering a ping, preferring
+// replicas without errors, then the local one, then the first one.
+func (clickhouse *Client) HealthyReplicas(replicas []Replica) ([]Replica, error) {
+	shards := map[uint32][]Replica{}
+	var shardNums []uint32
+	for _, replica := range replicas {
+		if _, ok := shards[replica.Shard]; !ok {
+			shardNums = append(shardNums, replica.Shard)
+		}
+		shards[replica.Shard] = append(shards[replica.Shard], replica)
+	}
+	var healthy []Replica
+	for _, shard := range shardNums {
+		candidates := shards[shard]
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if (candidates[i].Errors == 0) != (candidates[j].Errors == 0) {
+				return candidates[i].Errors == 0
+			}
+			return candidates[i].IsLocal > candidates[j].IsLocal
+		})
+		found := false
+		for _, candidate := range candidates {
+			client := clickhouse.ForReplica(candidate)
+			if err := client.Connect(""); err != nil {
+				log.Warnf("replica %d of shard %d '%s' is unavailable: %v", candidate.Replica, shard, candidate.Host, err)
+				continue
+			}
+			client.CloseConnection()
+			healthy = append(healthy, candidate)
+			found = true
+			break
+		}
+		if !found {
+			err := fmt.Errorf("no healthy replica of shard %d", shard)
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+	}
+	return healthy, nil
+}
+
+// FreezeWithName freezes the tables into shadow/<name> without printing, so
+// freezes of several replicas can run together.
+func (clickhouse *Client) FreezeWithName(database string, tables []Table, name string) error {
+	for _, table := range tables {
+		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE WITH NAME '%s'", database, table.Name, name)
+		if _, err := clickhouse.Connection.Exec(query); err != nil {
+			err = fmt.Errorf("can't freeze '%s.%s' on '%s': %w", database, table.Name, clickhouse.Config.Host, err)
+			log.Errorf("%+v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNoShards is returned for a cluster manifest without shards.
+var ErrNoShards = errors.New("cluster manifest has no shards")
@@ -0,0 +1,352 @@
+package clickhouse
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/progress"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	KeeperFile = "keeper.json"
+	// keeperBatchSize is the number of paths read by one query.
+	keeperBatchSize = 1000
+)
+
+// keeperSkippedNodes are the nodes of a replicated table whose subtrees aren't
+// backed up: the replication log, the queues and the deduplication blocks
+// only make sense for the running replicas, the parts of the replicas with
+// their checksums and columns are registered again when the data is attached.
+var keeperSkippedNodes = map[string]bool{
+	"log":           true,
+	"queue":         true,
+	"blocks":        true,
+	"block_numbers": true,
+	"temp":          true,
+	"parts":         true,
+}
+
+// replicatedEngineRegExp matches the Keeper path and the replica name of a
+// replicated table.
+var replicatedEngineRegExp = regexp.MustCompile(`ENGINE = Replicated\w*MergeTree\('([^']+)', *'([^']+)'`)
+
+// KeeperNode is a node of ZooKeeper or ClickHouse Keeper from system.zookeeper.
+type KeeperNode struct {
+	Path     string `db:"path" json:"path"`
+	Name     string `db:"name" json:"-"`
+	Value    string `db:"value" json:"value"`
+	Children int32  `db:"numChildren" json:"-"`
+}
+
+// KeeperTable is a replicated table with the Keeper subtree of its path.
+type KeeperTable struct {
+	Table         string       `db:"table" json:"table"`
+	ZooKeeperPath string       `db:"zookeeper_path" json:"zookeeper_path"`
+	ReplicaName   string       `db:"replica_name" json:"replica_name"`
+	Nodes         []KeeperNode `json:"nodes,omitempty"`
+}
+
+// KeeperBackup is the Keeper metadata of the replicated tables of a backup.
+type KeeperBackup struct {
+	Database  string        `json:"database"`
+	CreatedAt time.Time     `json:"created_at"`
+	Tables    []KeeperTable `json:"tables"`
+}
+
+// KeeperReplica is a replica registered in Keeper under the path of a table.
+type KeeperReplica struct {
+	Table         string `json:"table"`
+	ZooKeeperPath string `json:"zookeeper_path"`
+	Replica       string `json:"replica"`
+	Active        bool   `json:"active"`
+}
+
+func (clickhouse *Client) ReplicatedTables(database string) ([]KeeperTable, error) {
+	var tables []KeeperTable
+	if err := clickhouse.Connection.Select(&tables, "SELECT table, zookeeper_path, replica_name FROM system.replicas WHERE database = ? ORDER BY table", database); err != nil {
+		log.Errorf("can't get replicated tables of '%s': %v", database, err)
+		return nil, err
+	}
+	return tables, nil
+}
+
+// keeperChildren returns the children of the nodes, read in batches of
+// keeperBatchSize paths.
+func (clickhouse *Client) keeperChildren(nodePaths ...string) ([]KeeperNode, error) {
+	var nodes []KeeperNode
+	for start := 0; start < len(nodePaths); start += keeperBatchSize {
+		batch := nodePaths[start:min(start+keeperBatchSize, len(nodePaths))]
+		query, args, err := sqlx.In("SELECT name, value, numChildren, path FROM system.zookeeper WHERE path IN (?) ORDER BY path, name", batch)
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		var children []KeeperNode
+		if err := clickhouse.Connection.Select(&children, query, args...); err != nil {
+			log.Errorf("can't get keeper nodes of '%s': %v", strings.Join(batch, "', '"), err)
+			return nil, err
+		}
+		nodes = append(nodes, children...)
+	}
+	for i := range nodes {
+		nodes[i].Path = path.Join(nodes[i].Path, nodes[i].Name)
+	}
+	return nodes, nil
+}
+
+// keeperExists reports whether the node exists, system.zookeeper fails on
+// the children of a missing node, so the path is checked from the root.
+func (clickhouse *Client) keeperExists(nodePath string) (bool, error) {
+	parent := "/"
+	for _, name := range strings.Split(strings.Trim(nodePath, "/"), "/") {
+		var count int
+		if err := clickhouse.Connection.Get(&count, "SELECT count() FROM system.zookeeper WHERE path = ? AND name = ?", parent, name); err != nil {
+			log.Errorf("can't check keeper node '%s': %v", nodePath, err)
+			return false, err
+		}
+		if count == 0 {
+			return false, nil
+		}
+		parent = path.Join(parent, name)
+	}
+	return true, nil
+}
+
+// KeeperTree returns the nodes under the path sorted by path, except the
+// subtrees of keeperSkippedNodes. The tree is read level by level.
+func (clickhouse *Client) KeeperTree(rootPath string) ([]KeeperNode, error) {
+	var nodes []KeeperNode
+	for level := []string{rootPath}; len(level) > 0; {
+		children, err := clickhouse.keeperChildren(level...)
+		if err != nil {
+			return nil, err
+		}
+		level = nil
+		for _, child := range children {
+			nodes = append(nodes, child)
+			if child.Children > 0 && !keeperSkippedNodes[child.Name] {
+				level = append(level, child.Path)
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Path < nodes[j].Path
+	})
+	return nodes, nil
+}
+
+// NewKeeperBackup reads the Keeper subtrees of the replicated tables of the
+// database, nil is returned when it has none.
+func (clickhouse *Client) NewKeeperBackup(database string) (*KeeperBackup, error) {
+	tables, err := clickhouse.ReplicatedTables(database)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	fmt.Print("Backup keeper metadata...")
+	keeperProgress := progress.Start("keeper", 0)
+	keeperProgress.SetItems(len(tables), progress.UnitTables)
+	for i := range tables {
+		if tables[i].Nodes, err = clickhouse.KeeperTree(tables[i].ZooKeeperPath); err != nil {
+			keeperProgress.Finish()
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return nil, err
+		}
+		keeperProgress.Done()
+	}
+	keeperProgress.Finish()
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return &KeeperBackup{Database: database, CreatedAt: time.Now().UTC(), Tables: tables}, nil
+}
+
+// KeeperReplicas returns the replicas registered under the path of the table.
+func (clickhouse *Client) KeeperReplicas(table, zooKeeperPath string) ([]KeeperReplica, error) {
+	replicasPath := path.Join(zooKeeperPath, "replicas")
+	if exists, err := clickhouse.keeperExists(replicasPath); err != nil || !exists {
+		return nil, err
+	}
+	nodes, err := clickhouse.keeperChildren(replicasPath)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []KeeperReplica
+	for _, node := range nodes {
+		var active int
+		if err := clickhouse.Connection.Get(&active, "SELECT count() FROM system.zookeeper WHERE path = ? AND name = 'is_active'", node.Path); err != nil {
+			log.Errorf("can't check activity of replica '%s': %v", node.Path, err)
+			return nil, err
+		}
+		replicas = append(replicas, KeeperReplica{Table: table, ZooKeeperPath: zooKeeperPath, Replica: node.Name, Active: active > 0})
+	}
+	return replicas, nil
+}
+
+func (clickhouse *Client) macros() (map[string]string, error) {
+	var rows []struct {
+		Macro        string `db:"macro"`
+		Substitution string `db:"substitution"`
+	}
+	if err := clickhouse.Connection.Select(&rows, "SELECT macro, substitution FROM system.macros"); err != nil {
+		log.Errorf("can't get macros: %v", err)
+		return nil, err
+	}
+	macros := map[string]string{}
+	for _, row := range rows {
+		macros[row.Macro] = row.Substitution
+	}
+	return macros, nil
+}
+
+// hostsMacros returns the macros of the server or, in a cluster, of every
+// host of the cluster, the hosts creating the tables.
+func (clickhouse *Client) hostsMacros(cluster string, inCluster bool) ([]map[string]string, error) {
+	if !inCluster {
+		macros, err := clickhouse.macros()
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]string{macros}, nil
+	}
+	replicas, err := clickhouse.GetReplicas(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var hostsMacros []map[string]string
+	for _, replica := range replicas {
+		client := clickhouse.ForReplica(replica)
+		if err := client.Connect(""); err != nil {
+			return nil, err
+		}
+		macros, err := client.macros()
+		client.CloseConnection()
+		if err != nil {
+			return nil, err
+		}
+		hostsMacros = append(hostsMacros, macros)
+	}
+	return hostsMacros, nil
+}
+
+// replacer substitutes the macros and the {database} and {table} of a table.
+func replacer(macros map[string]string, database, table string) *strings.Replacer {
+	var pairs []string
+	for macro, substitution := range macros {
+		pairs = append(pairs, "{"+macro+"}", substitution)
+	}
+	return strings.NewReplacer(append(pairs, "{database}", database, "{table}", table)...)
+}
+
+// tableReplicas are the replica names the hosts register under the resolved
+// Keeper path of a replicated table.
+type tableReplicas struct {
+	table, zooKeeperPath string
+	names                map[string]bool
+}
+
+// registeredReplicas resolves the Keeper paths and the replica names of the
+// replicated tables of the schema queries with the macros of every host,
+// paths with {uuid} are new for every table and skipped.
+func registeredReplicas(database string, queries []SchemaQuery, hostsMacros []map[string]string) []tableReplicas {
+	var registered []tableReplicas
+	indexes := map[[2]string]int{}
+	for _, query := range queries {
+		matches := replicatedEngineRegExp.FindStringSubmatch(query.Query)
+		if matches == nil {
+			continue
+		}
+		table := strings.TrimSuffix(filepath.Base(query.File), ".sql")
+		for _, macros := range hostsMacros {
+			resolve := replacer(macros, database, table)
+			zooKeeperPath, replicaName := resolve.Replace(matches[1]), resolve.Replace(matches[2])
+			if strings.Contains(zooKeeperPath, "{") || strings.Contains(replicaName, "{") {
+				continue
+			}
+			index, ok := indexes[[2]string{table, zooKeeperPath}]
+			if !ok {
+				index = len(registered)
+				indexes[[2]string{table, zooKeeperPath}] = index
+				registered = append(registered, tableReplicas{table: table, zooKeeperPath: zooKeeperPath, names: map[string]bool{}})
+			}
+			registered[index].names[replicaName] = true
+		}
+	}
+	return registered
+}
+
+// StaleReplicas finds the inactive replicas left in Keeper under the paths of
+// the replicated tables of the schema queries with the names the hosts
+// creating the tables register, CREATE TABLE fails with "replica already
+// exists" on them. Replicas with other names are left alone.
+func (clickhouse *Client) StaleReplicas(database, cluster string, inCluster bool, queries []SchemaQuery) ([]KeeperReplica, error) {
+	var replicated bool
+	for _, query := range queries {
+		replicated = replicated || replicatedEngineRegExp.MatchString(query.Query)
+	}
+	if !replicated {
+		return nil, nil
+	}
+	hostsMacros, err := clickhouse.hostsMacros(cluster, inCluster)
+	if err != nil {
+		return nil, err
+	}
+	var stale []KeeperReplica
+	for _, registered := range registeredReplicas(database, queries, hostsMacros) {
+		replicas, err := clickhouse.KeeperReplicas(registered.table, registered.zooKeeperPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, replica := range replicas {
+			if !replica.Active && registered.names[replica.Replica] {
+				stale = append(stale, replica)
+			}
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		return stale[i].Table < stale[j].Table
+	})
+	if len(stale) > 0 {
+		helper.ColoredPrintln(helper.ColorYellow, fmt.Sprintf("Found %d stale replicas in keeper:", len(stale)))
+		PrintKeeperReplicas(helper.ColorYellow, stale)
+	}
+	return stale, nil
+}
+
+func DropReplicaQuery(replica KeeperReplica) string {
+	return fmt.Sprintf("SYSTEM DROP REPLICA '%s' FROM ZKPATH '%s'", replica.Replica, replica.ZooKeeperPath)
+}
+
+// DropReplicas removes the metadata of the inactive replicas from Keeper.
+func (clickhouse *Client) DropReplicas(replicas []KeeperReplica) error {
+	if len(replicas) == 0 {
+		return nil
+	}
+	fmt.Print("Drop stale replicas...")
+	for _, replica := range replicas {
+		if _, err := clickhouse.Connection.Exec(DropReplicaQuery(replica)); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			log.Errorf("can't drop replica '%s' of '%s': %v", replica.Replica, replica.ZooKeeperPath, err)
+			return err
+		}
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func PrintKeeperReplicas(color string, replicas []KeeperReplica) {
+	rows := [][]string{{"TABLE", "ZOOKEEPER_PATH", "REPLICA", "ACTIVE"}}
+	for _, replica := range replicas {
+		rows = append(rows, []string{replica.Table, replica.ZooKeeperPath, replica.Replica, fmt.Sprint(replica.Active)})
+	}
+	printTable(color, rows)
+}
+
+// ErrStaleReplicas is returned when stale replicas block the restore and
+// aren't allowed to be dropped.
+var ErrStaleReplicas = errors.New("stale replicas in keeper block the restore, use --drop-stale-replicas to drop them")
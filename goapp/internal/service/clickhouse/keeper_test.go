@@ -0,0 +1,28 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegisteredReplicas(t *testing.T) {
+	queries := []SchemaQuery{
+		{File: "metadata/events.sql", Query: "CREATE TABLE IF NOT EXISTS db.events ON CLUSTER main (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}') ORDER BY id"},
+		{File: "metadata/users.sql", Query: "CREATE TABLE IF NOT EXISTS db.users ON CLUSTER main (id UInt64) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id"},
+		{File: "metadata/fixed.sql", Query: "CREATE TABLE IF NOT EXISTS db.fixed ON CLUSTER main (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/fixed', 'backup_{replica}') ORDER BY id"},
+		{File: "metadata/local.sql", Query: "CREATE TABLE IF NOT EXISTS db.local ON CLUSTER main (id UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+	hostsMacros := []map[string]string{
+		{"shard": "01", "replica": "host-1"},
+		{"shard": "01", "replica": "host-2"},
+		{"shard": "02", "replica": "host-3"},
+	}
+	expected := []tableReplicas{
+		{table: "events", zooKeeperPath: "/clickhouse/tables/01/db/events", names: map[string]bool{"host-1": true, "host-2": true}},
+		{table: "events", zooKeeperPath: "/clickhouse/tables/02/db/events", names: map[string]bool{"host-3": true}},
+		{table: "fixed", zooKeeperPath: "/clickhouse/fixed", names: map[string]bool{"backup_host-1": true, "backup_host-2": true, "backup_host-3": true}},
+	}
+	if registered := registeredReplicas("db", queries, hostsMacros); !reflect.DeepEqual(registered, expected) {
+		t.Fatalf("unexpected registered replicas %+v", registered)
+	}
+}
@@ -0,0 +1,285 @@
+package clickhouse
+
+import (
+	"clickhouse-tools/internal/helper"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ManifestFile = "manifest.json"
+	countFile    = "count.txt"
+)
+
+// Manifest records the data of a backup per table and partition, it is
+// checked against system.parts after the restore.
+type Manifest struct {
+	Database   string           `json:"database"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Partitions []PartitionStats `json:"partitions"`
+}
+
+type PartitionStats struct {
+	Table     string `json:"table" db:"table"`
+	Partition string `json:"partition" db:"partition_id"`
+	Rows      uint64 `json:"rows" db:"rows"`
+	Parts     uint64 `json:"parts" db:"parts"`
+	Bytes     uint64 `json:"bytes" db:"bytes"`
+}
+
+// Mismatch is a difference between the manifest and the restored data.
+type Mismatch struct {
+	Table     string `json:"table"`
+	Partition string `json:"partition,omitempty"`
+	Metric    string `json:"metric"`
+	Expected  uint64 `json:"expected"`
+	Actual    uint64 `json:"actual"`
+}
+
+// NewManifest collects the manifest from the frozen parts in the shadow store
+// directory, laid out as <uuid prefix>/<uuid>/<part>. The rows of a part are
+// in its count.txt and its bytes are the sizes of its files, as in
+// system.parts.
+func NewManifest(database, storePath string, tables []Table) (*Manifest, error) {
+	manifest := &Manifest{Database: database, CreatedAt: time.Now().UTC()}
+	for _, table := range tables {
+		tablePath := path.Join(storePath, string([]rune(table.UUID)[:3]), table.UUID)
+		entries, err := os.ReadDir(tablePath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		var partDirs []string
+		for _, entry := range entries {
+			if entry.IsDir() {
+				partDirs = append(partDirs, entry.Name())
+			}
+		}
+		parts, _ := planParts(table.Name, partDirs)
+		stats := map[string]*PartitionStats{}
+		for _, name := range parts {
+			part, _ := ParsePart(name)
+			rows, bytes, err := partStats(path.Join(tablePath, name))
+			if err != nil {
+				return nil, err
+			}
+			if stats[part.Partition] == nil {
+				stats[part.Partition] = &PartitionStats{Table: table.Name, Partition: part.Partition}
+			}
+			stats[part.Partition].Rows += rows
+			stats[part.Partition].Bytes += bytes
+			stats[part.Partition].Parts++
+		}
+		for _, partition := range stats {
+			manifest.Partitions = append(manifest.Partitions, *partition)
+		}
+	}
+	sortPartitions(manifest.Partitions)
+	return manifest, nil
+}
+
+func partStats(partPath string) (rows, bytes uint64, err error) {
+	count, err := helper.ReadFile(path.Join(partPath, countFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	if rows, err = strconv.ParseUint(count, 10, 64); err != nil {
+		log.Errorf("can't read rows of part '%s': %v", partPath, err)
+		return 0, 0, err
+	}
+	err = filepath.Walk(partPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			bytes += uint64(fileInfo.Size())
+		}
+		return nil
+	})
+	return rows, bytes, err
+}
+
+// ReadManifest reads the manifest of the backup extracted to backupPath. Backups
+// created before manifests were added have none, nil is returned for them.
+func ReadManifest(backupPath string) (*Manifest, error) {
+	content, err := os.ReadFile(path.Join(backupPath, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		log.Errorf("can't read backup manifest: %v", err)
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Only returns the manifest of the listed tables, the whole manifest when the
+// list is empty.
+func (manifest *Manifest) Only(tables []string) *Manifest {
+	if manifest == nil || len(tables) == 0 {
+		return manifest
+	}
+	filtered := *manifest
+	filtered.Partitions = nil
+	for _, partition := range manifest.Partitions {
+		for _, table := range tables {
+			if partition.Table == table {
+				filtered.Partitions = append(filtered.Partitions, partition)
+				break
+			}
+		}
+	}
+	return &filtered
+}
+
+// Validate compares the active parts of the restored database with the
+// manifest and checks that no parts are left detached, only for the listed
+// tables when the list isn't empty.
+func (clickhouse *Client) Validate(database string, manifest *Manifest, only []string) ([]Mismatch, error) {
+	fmt.Print("Validate restored data\t...")
+	var actual []PartitionStats
+	if err := clickhouse.Connection.Select(&actual, "SELECT table, partition_id, sum(rows) AS rows, count() AS parts, sum(bytes_on_disk) AS bytes FROM system.parts WHERE active AND database = ? GROUP BY table, partition_id", database); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		log.Errorf("can't get parts of database '%s': %v", database, err)
+		return nil, err
+	}
+	var detached []struct {
+		Table string `db:"table"`
+		Parts uint64 `db:"parts"`
+	}
+	if err := clickhouse.Connection.Select(&detached, "SELECT table, count() AS parts FROM system.detached_parts WHERE database = ? GROUP BY table", database); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		log.Errorf("can't get detached parts of database '%s': %v", database, err)
+		return nil, err
+	}
+
+	listed := func(table string) bool {
+		for _, name := range only {
+			if name == table {
+				return true
+			}
+		}
+		return len(only) == 0
+	}
+
+	type key struct{ table, partition string }
+	expected := map[key]PartitionStats{}
+	for _, partition := range manifest.Partitions {
+		expected[key{partition.Table, partition.Partition}] = partition
+	}
+	var mismatches []Mismatch
+	compare := func(table, partition string, want, got PartitionStats) {
+		for _, metric := range []struct {
+			name      string
+			want, got uint64
+		}{
+			{"rows", want.Rows, got.Rows},
+			{"parts", want.Parts, got.Parts},
+			{"bytes", want.Bytes, got.Bytes},
+		} {
+			if metric.want != metric.got {
+				mismatches = append(mismatches, Mismatch{
+					Table:     table,
+					Partition: partition,
+					Metric:    metric.name,
+					Expected:  metric.want,
+					Actual:    metric.got,
+				})
+			}
+		}
+	}
+	sortPartitions(actual)
+	for _, got := range actual {
+		if !listed(got.Table) {
+			continue
+		}
+		compare(got.Table, got.Partition, expected[key{got.Table, got.Partition}], got)
+		delete(expected, key{got.Table, got.Partition})
+	}
+	for _, want := range manifest.Partitions {
+		if _, ok := expected[key{want.Table, want.Partition}]; ok {
+			compare(want.Table, want.Partition, want, PartitionStats{})
+		}
+	}
+	for _, table := range detached {
+		if !listed(table.Table) {
+			continue
+		}
+		mismatches = append(mismatches, Mismatch{Table: table.Table, Metric: "detached parts", Actual: table.Parts})
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		if mismatches[i].Table != mismatches[j].Table {
+			return mismatches[i].Table < mismatches[j].Table
+		}
+		return mismatches[i].Partition < mismatches[j].Partition
+	})
+	if len(mismatches) > 0 {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		printMismatches(mismatches)
+		err := fmt.Errorf("restored data doesn't match the backup manifest: %d mismatches", len(mismatches))
+		log.Errorf("%+v", err)
+		return mismatches, err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil, nil
+}
+
+func printMismatches(mismatches []Mismatch) {
+	rows := [][]string{{"TABLE", "PARTITION", "METRIC", "EXPECTED", "ACTUAL"}}
+	for _, mismatch := range mismatches {
+		rows = append(rows, []string{
+			mismatch.Table,
+			mismatch.Partition,
+			mismatch.Metric,
+			strconv.FormatUint(mismatch.Expected, 10),
+			strconv.FormatUint(mismatch.Actual, 10),
+		})
+	}
+	printTable(helper.ColorRed, rows)
+}
+
+// printTable prints the rows in aligned columns, the first row is the header.
+func printTable(color string, rows [][]string) {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-len(cell))
+		}
+		helper.ColoredPrintln(color, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+}
+
+func sortPartitions(partitions []PartitionStats) {
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Table != partitions[j].Table {
+			return partitions[i].Table < partitions[j].Table
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+}
@@ -0,0 +1,97 @@
+package clickhouse
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	PartAttached = "attached"
+	PartSkipped  = "skipped"
+	PartFailed   = "failed"
+)
+
+// partNameRegExp matches <partition_id>_<min_block>_<max_block>_<level> with
+// an optional _<mutation>. Partition IDs are numeric, "all" for tuple() or a
+// hash for string keys, without underscores.
+var partNameRegExp = regexp.MustCompile(`^([0-9A-Za-z-]+)_(\d+)_(\d+)_(\d+)(?:_(\d+))?$`)
+
+// Part is a data part of a MergeTree table parsed from its directory name.
+type Part struct {
+	Name, Partition    string
+	MinBlock, MaxBlock int64
+	Level, Mutation    int64
+}
+
+// PartResult is the outcome of attaching a part.
+type PartResult struct {
+	Table  string `json:"table"`
+	Part   string `json:"part"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func ParsePart(name string) (Part, bool) {
+	matches := partNameRegExp.FindStringSubmatch(name)
+	if matches == nil {
+		return Part{}, false
+	}
+	part := Part{Name: name, Partition: matches[1]}
+	part.MinBlock, _ = strconv.ParseInt(matches[2], 10, 64)
+	part.MaxBlock, _ = strconv.ParseInt(matches[3], 10, 64)
+	part.Level, _ = strconv.ParseInt(matches[4], 10, 64)
+	part.Mutation, _ = strconv.ParseInt(matches[5], 10, 64)
+	return part, true
+}
+
+// covers reports whether the part contains all the blocks of the other part.
+func (part Part) covers(other Part) bool {
+	return part.Partition == other.Partition &&
+		part.MinBlock <= other.MinBlock && other.MaxBlock <= part.MaxBlock &&
+		part.Level >= other.Level
+}
+
+// planParts splits the part directories of the table into the parts to
+// attach, sorted by name, and the skipped ones: duplicates, directories not
+// named as parts and parts covered by another part.
+func planParts(table string, names []string) ([]string, []PartResult) {
+	var (
+		parts   []Part
+		skipped []PartResult
+		seen    = map[string]bool{}
+	)
+	for _, name := range names {
+		if seen[name] {
+			skipped = append(skipped, PartResult{Table: table, Part: name, Status: PartSkipped, Error: "duplicate"})
+			continue
+		}
+		seen[name] = true
+		part, ok := ParsePart(name)
+		if !ok {
+			skipped = append(skipped, PartResult{Table: table, Part: name, Status: PartSkipped, Error: "not a part directory"})
+			continue
+		}
+		parts = append(parts, part)
+	}
+	var attach []string
+	for i, part := range parts {
+		coveredBy := ""
+		for j, other := range parts {
+			// Of two parts with the same blocks the later mutation wins.
+			if i != j && other.covers(part) &&
+				(!part.covers(other) || other.Mutation > part.Mutation || other.Mutation == part.Mutation && j < i) {
+				coveredBy = other.Name
+				break
+			}
+		}
+		if coveredBy != "" {
+			skipped = append(skipped, PartResult{Table: table, Part: part.Name, Status: PartSkipped, Error: fmt.Sprintf("covered by %s", coveredBy)})
+			continue
+		}
+		attach = append(attach, part.Name)
+	}
+	sort.Strings(attach)
+	return attach, skipped
+}
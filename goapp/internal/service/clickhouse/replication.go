@@ -0,0 +1,102 @@
+package clickhouse
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/progress"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	replicationPollPeriod = time.Second
+)
+
+// SchemaEngines returns the engines of the tables of the backup extracted to
+// backupPath by table name, read from their CREATE queries.
+func SchemaEngines(backupPath string) (map[string]string, error) {
+	engines := map[string]string{}
+	re := regexp.MustCompile(`ENGINE = (\w+)`)
+	err := filepath.Walk(path.Join(backupPath, "metadata"), func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+		if filepath.Ext(filePath) != ".sql" {
+			return nil
+		}
+		query, err := helper.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if matches := re.FindStringSubmatch(query); matches != nil {
+			engines[strings.TrimSuffix(fileInfo.Name(), ".sql")] = matches[1]
+		}
+		return nil
+	})
+	return engines, err
+}
+
+// IsReplicated reports whether the table of the engine is replicated.
+func IsReplicated(engine string) bool {
+	return strings.HasPrefix(engine, "Replicated")
+}
+
+// IsMergeTree reports whether the table of the engine has data parts.
+func IsMergeTree(engine string) bool {
+	return strings.HasSuffix(engine, "MergeTree")
+}
+
+func (clickhouse *Client) replicationQueueSize(database string) (int, error) {
+	var size int
+	if err := clickhouse.Connection.Get(&size, "SELECT count() FROM system.replication_queue WHERE database = ?", database); err != nil {
+		log.Errorf("can't get replication queue of '%s' on '%s': %v", database, clickhouse.Config.Host, err)
+		return 0, err
+	}
+	return size, nil
+}
+
+// WaitReplication waits until the replication queue of the database drains
+// on the replica, reporting the progress of the replica.
+func (clickhouse *Client) WaitReplication(database string, timeout time.Duration) error {
+	fmt.Printf("Wait for replication on '%s'...", clickhouse.Config.Host)
+	size, err := clickhouse.replicationQueueSize(database)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	total, done := size, 0
+	replicationProgress := progress.Start("replication "+clickhouse.Config.Host, 0)
+	replicationProgress.SetItems(total, progress.UnitEntries)
+	deadline := time.Now().Add(timeout)
+	for size > 0 {
+		if time.Now().After(deadline) {
+			replicationProgress.Finish()
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			err := fmt.Errorf("replication queue of '%s' on '%s' still has %d entries after %s", database, clickhouse.Config.Host, size, timeout)
+			log.Errorf("%+v", err)
+			return err
+		}
+		time.Sleep(replicationPollPeriod)
+		if size, err = clickhouse.replicationQueueSize(database); err != nil {
+			replicationProgress.Finish()
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+		if size > total {
+			total = size
+			replicationProgress.SetItems(total, progress.UnitEntries)
+		}
+		for ; done < total-size; done++ {
+			replicationProgress.Done()
+		}
+	}
+	replicationProgress.Finish()
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
@@ -0,0 +1,85 @@
+package clickhouse
+
+import (
+	"clickhouse-tools/internal/helper"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotSuffix     = "_pre_restore_"
+	snapshotTimeFormat = "20060102_150405"
+)
+
+// SnapshotName names the database keeping the data of the database before a
+// restore, e.g. db_pre_restore_20240102_030405.
+func SnapshotName(database string, at time.Time) string {
+	return database + snapshotSuffix + at.UTC().Format(snapshotTimeFormat)
+}
+
+// IsSnapshotOf reports whether name is a snapshot database of the database.
+func IsSnapshotOf(name, database string) bool {
+	_, err := time.Parse(snapshotTimeFormat, strings.TrimPrefix(name, database+snapshotSuffix))
+	return strings.HasPrefix(name, database+snapshotSuffix) && err == nil
+}
+
+func RenameDatabaseQuery(from, to, cluster string, inCluster bool) string {
+	var onCluster string
+	if inCluster {
+		onCluster = fmt.Sprintf("ON CLUSTER %s", cluster)
+	}
+	return fmt.Sprintf("RENAME DATABASE %s TO %s %s", from, to, onCluster)
+}
+
+// GetSnapshots returns the snapshot databases of the database, newest first.
+func (clickhouse *Client) GetSnapshots(database string) ([]string, error) {
+	databases, err := clickhouse.GetDatabases()
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []string
+	for _, name := range databases {
+		if IsSnapshotOf(name, database) {
+			snapshots = append(snapshots, name)
+		}
+	}
+	// The timestamp format sorts by name.
+	sort.Sort(sort.Reverse(sort.StringSlice(snapshots)))
+	return snapshots, nil
+}
+
+// Snapshot renames the database to a new snapshot database and returns its
+// name. Only databases with the Atomic engine can be renamed.
+func (clickhouse *Client) Snapshot(database, cluster string, inCluster bool) (string, error) {
+	snapshot := SnapshotName(database, time.Now())
+	fmt.Printf("Rename database to '%s'...", snapshot)
+	query := RenameDatabaseQuery(database, snapshot, cluster, inCluster)
+	if _, err := clickhouse.Connection.Exec(query); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		log.Errorf("can't rename database '%s' to '%s': %v", database, snapshot, err)
+		return "", err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return snapshot, nil
+}
+
+// SwapBack replaces the database by its snapshot.
+func (clickhouse *Client) SwapBack(database, snapshot, cluster string, inCluster bool) error {
+	fmt.Printf("Rename database '%s' back to '%s'...", snapshot, database)
+	queries := []string{
+		DropDatabaseQueries(database, cluster, inCluster)[0],
+		RenameDatabaseQuery(snapshot, database, cluster, inCluster),
+	}
+	for _, query := range queries {
+		if _, err := clickhouse.Connection.Exec(query); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			log.Errorf("can't swap database '%s' back from '%s' by '%s': %v", database, snapshot, query, err)
+			return err
+		}
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
@@ -2,26 +2,76 @@ package config
 
 import (
 	"clickhouse-tools/internal/service/clickhouse"
+	"clickhouse-tools/internal/service/remote"
+	"clickhouse-tools/internal/service/storage/azblob"
+	"clickhouse-tools/internal/service/storage/gcs"
+	"clickhouse-tools/internal/service/storage/local"
 	"clickhouse-tools/internal/service/storage/rsync"
 	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/internal/service/storage/sftp"
 	"clickhouse-tools/pkg/archiver"
 	"clickhouse-tools/pkg/elk_writer"
 	"clickhouse-tools/pkg/encryptor"
+	"clickhouse-tools/pkg/progress"
+	"clickhouse-tools/pkg/throttle"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Task holds the defaults of the task command.
+type Task struct {
+	Storages      []string
+	SuccessPolicy string
+}
+
+// Throttle holds the process priority and the transfer limits overriding
+// the limits of every storage; limits are in bytes per second.
+type Throttle struct {
+	UploadLimit, DownloadLimit int64
+	Nice                       int
+	IONice                     string
+}
+
+// StorageProfile is a named storage target of one of the storage types, e.g.
+// two s3 buckets in different regions.
+type StorageProfile struct {
+	Name   string
+	Type   string
+	Rsync  *rsync.Config
+	S3     *s3.Config
+	GCS    *gcs.Config
+	AzBlob *azblob.Config
+	Sftp   *sftp.Config
+	Local  *local.Config
+}
+
+// envReader reads a variable with the prefix first and falls back to the
+// variable without it, so a profile only overrides what differs.
+type envReader struct {
+	prefix string
+}
+
 type Application struct {
 	Clickhouse *clickhouse.Config
 	Rsync      *rsync.Config
 	Archiver   *archiver.Config
 	S3         *s3.Config
+	GCS        *gcs.Config
+	AzBlob     *azblob.Config
+	Sftp       *sftp.Config
+	Local      *local.Config
 	Encryption *encryptor.Config
 	ElkWriter  *elk_writer.Config
+	Task       *Task
+	Throttle   *Throttle
+	Progress   *progress.Config
+	Cluster    *remote.Config
+	Storages   map[string]*StorageProfile
 }
 
 func New() *Application {
@@ -34,56 +84,214 @@ func New() *Application {
 		log.Fatalf("No '%s/.env' file", path)
 	}
 
-	return &Application{
+	application := &Application{
 		Clickhouse: &clickhouse.Config{
 			Host:     getEnvVarAsString("CLICKHOUSE_HOST", ""),
 			Port:     getEnvVarAsInt("CLICKHOUSE_PORT", 0),
 			Username: getEnvVarAsString("CLICKHOUSE_USERNAME", ""),
 			Password: getEnvVarAsString("CLICKHOUSE_PASSWORD", ""),
 		},
-		Rsync: &rsync.Config{
-			Host:       getEnvVarAsString("RSYNC_HOST", ""),
-			Username:   getEnvVarAsString("RSYNC_USER", ""),
-			Password:   getEnvVarAsString("RSYNC_PASSWORD", ""),
-			RemotePath: getEnvVarAsString("RSYNC_REMOTE_PATH", ""),
-			SSHKeyPath: getEnvVarAsString("RSYNC_SSH_KEY_PATH", ""),
-			UseSSH:     getEnvVarAsBool("RSYNC_USE_SSH", false),
-		},
+		Rsync: newRsyncConfig(envReader{}),
 		Archiver: &archiver.Config{
 			CompressionFormat: getEnvVarAsString("ARCHIVER_COMPRESSION_FORMAT", "tar"),
 			CompressionLevel:  getEnvVarAsInt("ARCHIVER_COMPRESSION_LEVEL", 9),
+			ReadLimit:         getEnvVarAsRate("ARCHIVER_READ_LIMIT", 0),
 		},
-		S3: &s3.Config{
-			Write: &s3.Keys{
-				AccessKey: getEnvVarAsString("S3_ACCESS_KEY_WRITE", ""),
-				SecretKey: getEnvVarAsString("S3_SECRET_KEY_WRITE", ""),
-			},
-			Read: &s3.Keys{
-				AccessKey: getEnvVarAsString("S3_ACCESS_KEY_READ", ""),
-				SecretKey: getEnvVarAsString("S3_SECRET_KEY_READ", ""),
-			},
-			Endpoint:                getEnvVarAsString("S3_ENDPOINT", ""),
-			Bucket:                  getEnvVarAsString("S3_BUCKET", ""),
-			Directory:               getEnvVarAsString("S3_DIRECTORY", ""),
-			Region:                  getEnvVarAsString("S3_REGION", ""),
-			ACL:                     getEnvVarAsString("S3_ACL", "private"),
-			DisableSSL:              getEnvVarAsBool("S3_DISABLE_SSL", false),
-			DisableCertVerification: getEnvVarAsBool("S3_DISABLE_CERT_VERIFICATION", false),
-			PartSize:                getEnvVarAsInt64("S3_PART_SIZE", 100*1024*1024),
-			SSE:                     getEnvVarAsString("S3_SERVER_SIDE_ENCRYPTION", ""),
-			ForcePathStyle:          getEnvVarAsBool("S3_FORCE_PATH_STYLE", true),
-		},
+		S3:     newS3Config(envReader{}),
+		GCS:    newGCSConfig(envReader{}),
+		AzBlob: newAzBlobConfig(envReader{}),
+		Sftp:   newSftpConfig(envReader{}),
+		Local:  newLocalConfig(envReader{}),
 		Encryption: &encryptor.Config{
-			SecretKey:  getEnvVarAsString("ENCRYPTION_SECRET_KEY", ""),
-			BufferSize: getEnvVarAsInt("ENCRYPTION_BUFFER_SIZE", 500*1024*1024),
+			SecretKey:      getEnvVarAsString("ENCRYPTION_SECRET_KEY", ""),
+			BufferSize:     getEnvVarAsInt("ENCRYPTION_BUFFER_SIZE", 500*1024*1024),
+			AllowPlaintext: getEnvVarAsBool("ENCRYPTION_ALLOW_PLAINTEXT", false),
 		},
 		ElkWriter: &elk_writer.Config{
 			ConnectionNetwork: getEnvVarAsString("ELK_CONNECTION_NETWORK", ""),
 			ConnectionUrl:     getEnvVarAsString("ELK_CONNECTION_URL", ""),
 		},
+		Task: &Task{
+			Storages:      getEnvVarAsSlice("TASK_STORAGES", nil, ","),
+			SuccessPolicy: getEnvVarAsString("TASK_SUCCESS_POLICY", "all"),
+		},
+		Throttle: &Throttle{
+			UploadLimit:   getEnvVarAsRate("THROTTLE_UPLOAD_LIMIT", 0),
+			DownloadLimit: getEnvVarAsRate("THROTTLE_DOWNLOAD_LIMIT", 0),
+			Nice:          getEnvVarAsInt("THROTTLE_NICE", 0),
+			IONice:        getEnvVarAsString("THROTTLE_IONICE", ""),
+		},
+		Progress: &progress.Config{
+			Enabled:     getEnvVarAsBool("PROGRESS_ENABLED", true),
+			LogInterval: time.Duration(getEnvVarAsInt("PROGRESS_LOG_INTERVAL", 30)) * time.Second,
+		},
+		Cluster: &remote.Config{
+			Username:              getEnvVarAsString("CLUSTER_SSH_USERNAME", "root"),
+			Password:              getEnvVarAsString("CLUSTER_SSH_PASSWORD", ""),
+			KeyPath:               getEnvVarAsString("CLUSTER_SSH_KEY_PATH", ""),
+			KnownHostsPath:        getEnvVarAsString("CLUSTER_SSH_KNOWN_HOSTS_PATH", "/root/.ssh/known_hosts"),
+			InsecureIgnoreHostKey: getEnvVarAsBool("CLUSTER_SSH_INSECURE_IGNORE_HOST_KEY", false),
+			Port:                  getEnvVarAsInt("CLUSTER_SSH_PORT", 22),
+			ToolPath:              getEnvVarAsString("CLUSTER_TOOL_PATH", "/usr/local/bin/clickhouse-tools/clickhouse-tools"),
+		},
+		Storages: map[string]*StorageProfile{},
+	}
+	for _, name := range getEnvVarAsSlice("STORAGES", nil, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		application.Storages[name] = newStorageProfile(name)
+	}
+	return application
+}
+
+// DefaultStorageProfile returns the storage configured by the variables
+// without a profile prefix, addressed by the storage type name.
+func (app *Application) DefaultStorageProfile(storageType string) *StorageProfile {
+	return &StorageProfile{
+		Name:   storageType,
+		Type:   storageType,
+		Rsync:  app.Rsync,
+		S3:     app.S3,
+		GCS:    app.GCS,
+		AzBlob: app.AzBlob,
+		Sftp:   app.Sftp,
+		Local:  app.Local,
+	}
+}
+
+// newStorageProfile reads a profile from STORAGE_<NAME>_TYPE and the usual
+// storage variables prefixed with STORAGE_<NAME>_, where the name is upper
+// cased and dashes are replaced by underscores.
+func newStorageProfile(name string) *StorageProfile {
+	env := envReader{prefix: "STORAGE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"}
+	return &StorageProfile{
+		Name:   name,
+		Type:   getEnvVarAsString(env.prefix+"TYPE", ""),
+		Rsync:  newRsyncConfig(env),
+		S3:     newS3Config(env),
+		GCS:    newGCSConfig(env),
+		AzBlob: newAzBlobConfig(env),
+		Sftp:   newSftpConfig(env),
+		Local:  newLocalConfig(env),
+	}
+}
+
+func newRsyncConfig(env envReader) *rsync.Config {
+	return &rsync.Config{
+		Host:                  env.asString("RSYNC_HOST", ""),
+		Port:                  env.asInt("RSYNC_PORT", 22),
+		Username:              env.asString("RSYNC_USER", "root"),
+		Password:              env.asString("RSYNC_PASSWORD", ""),
+		RemotePath:            env.asString("RSYNC_REMOTE_PATH", ""),
+		SSHKeyPath:            env.asString("RSYNC_SSH_KEY_PATH", ""),
+		KnownHostsPath:        env.asString("RSYNC_KNOWN_HOSTS_PATH", "/root/.ssh/known_hosts"),
+		InsecureIgnoreHostKey: env.asBool("RSYNC_INSECURE_IGNORE_HOST_KEY", false),
+		UseSSH:                env.asBool("RSYNC_USE_SSH", false),
+		BwLimit:               env.asRate("RSYNC_BWLIMIT", 0),
+	}
+}
+
+func newS3Config(env envReader) *s3.Config {
+	return &s3.Config{
+		Write: &s3.Keys{
+			AccessKey: env.asString("S3_ACCESS_KEY_WRITE", ""),
+			SecretKey: env.asString("S3_SECRET_KEY_WRITE", ""),
+			RoleArn:   env.asString("S3_ROLE_ARN_WRITE", env.asString("S3_ROLE_ARN", "")),
+		},
+		Read: &s3.Keys{
+			AccessKey: env.asString("S3_ACCESS_KEY_READ", ""),
+			SecretKey: env.asString("S3_SECRET_KEY_READ", ""),
+			RoleArn:   env.asString("S3_ROLE_ARN_READ", env.asString("S3_ROLE_ARN", "")),
+		},
+		Profile:                 env.asString("S3_PROFILE", ""),
+		RoleExternalId:          env.asString("S3_ROLE_EXTERNAL_ID", ""),
+		StsEndpoint:             env.asString("S3_STS_ENDPOINT", ""),
+		ObjectLockMode:          env.asString("S3_OBJECT_LOCK_MODE", ""),
+		ObjectLockRetentionDays: env.asInt("S3_OBJECT_LOCK_RETENTION_DAYS", 30),
+		Endpoint:                env.asString("S3_ENDPOINT", ""),
+		Bucket:                  env.asString("S3_BUCKET", ""),
+		Directory:               env.asString("S3_DIRECTORY", ""),
+		Region:                  env.asString("S3_REGION", ""),
+		ACL:                     env.asString("S3_ACL", "private"),
+		DisableSSL:              env.asBool("S3_DISABLE_SSL", true),
+		DisableCertVerification: env.asBool("S3_DISABLE_CERT_VERIFICATION", false),
+		PartSize:                env.asInt64("S3_PART_SIZE", 100*1024*1024),
+		SSE:                     env.asString("S3_SERVER_SIDE_ENCRYPTION", ""),
+		SSEKMSKeyId:             env.asString("S3_SSE_KMS_KEY_ID", ""),
+		SSECustomerKey:          env.asString("S3_SSE_CUSTOMER_KEY", ""),
+		StorageClass:            env.asString("S3_STORAGE_CLASS", ""),
+		CABundle:                env.asString("S3_CA_BUNDLE", ""),
+		Concurrency:             env.asInt("S3_CONCURRENCY", 5),
+		ForcePathStyle:          env.asBool("S3_FORCE_PATH_STYLE", true),
+		UploadLimit:             env.asRate("S3_UPLOAD_LIMIT", 0),
+		DownloadLimit:           env.asRate("S3_DOWNLOAD_LIMIT", 0),
 	}
 }
 
+func newGCSConfig(env envReader) *gcs.Config {
+	return &gcs.Config{
+		Endpoint:        env.asString("GCS_ENDPOINT", gcs.DefaultEndpoint),
+		Bucket:          env.asString("GCS_BUCKET", ""),
+		Directory:       env.asString("GCS_DIRECTORY", ""),
+		CredentialsFile: env.asString("GCS_CREDENTIALS_FILE", ""),
+		ChunkSize:       env.asInt64("GCS_CHUNK_SIZE", 16*1024*1024),
+	}
+}
+
+func newAzBlobConfig(env envReader) *azblob.Config {
+	return &azblob.Config{
+		AccountName: env.asString("AZBLOB_ACCOUNT_NAME", ""),
+		AccountKey:  env.asString("AZBLOB_ACCOUNT_KEY", ""),
+		SASToken:    env.asString("AZBLOB_SAS_TOKEN", ""),
+		Endpoint:    env.asString("AZBLOB_ENDPOINT", ""),
+		Container:   env.asString("AZBLOB_CONTAINER", ""),
+		Prefix:      env.asString("AZBLOB_PREFIX", ""),
+		BlockSize:   env.asInt64("AZBLOB_BLOCK_SIZE", 64*1024*1024),
+		Concurrency: env.asInt("AZBLOB_CONCURRENCY", 4),
+	}
+}
+
+func newSftpConfig(env envReader) *sftp.Config {
+	return &sftp.Config{
+		Host:                  env.asString("SFTP_HOST", ""),
+		Port:                  env.asInt("SFTP_PORT", 22),
+		Username:              env.asString("SFTP_USERNAME", "root"),
+		Password:              env.asString("SFTP_PASSWORD", ""),
+		KeyPath:               env.asString("SFTP_KEY_PATH", ""),
+		KnownHostsPath:        env.asString("SFTP_KNOWN_HOSTS_PATH", "/root/.ssh/known_hosts"),
+		InsecureIgnoreHostKey: env.asBool("SFTP_INSECURE_IGNORE_HOST_KEY", false),
+		RemotePath:            env.asString("SFTP_REMOTE_PATH", ""),
+	}
+}
+
+func newLocalConfig(env envReader) *local.Config {
+	return &local.Config{
+		Path: env.asString("LOCAL_PATH", ""),
+	}
+}
+
+func (env envReader) asString(name, defaultValue string) string {
+	return getEnvVarAsString(env.prefix+name, getEnvVarAsString(name, defaultValue))
+}
+
+func (env envReader) asInt(name string, defaultValue int) int {
+	return getEnvVarAsInt(env.prefix+name, getEnvVarAsInt(name, defaultValue))
+}
+
+func (env envReader) asInt64(name string, defaultValue int64) int64 {
+	return getEnvVarAsInt64(env.prefix+name, getEnvVarAsInt64(name, defaultValue))
+}
+
+func (env envReader) asBool(name string, defaultValue bool) bool {
+	return getEnvVarAsBool(env.prefix+name, getEnvVarAsBool(name, defaultValue))
+}
+
+func (env envReader) asRate(name string, defaultValue int64) int64 {
+	return getEnvVarAsRate(env.prefix+name, getEnvVarAsRate(name, defaultValue))
+}
+
 func getEnvVarAsString(name, defaultValue string) string {
 	if value, exists := os.LookupEnv(name); exists {
 		return value
@@ -115,6 +323,15 @@ func getEnvVarAsBool(name string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getEnvVarAsRate reads bytes per second like "10M", see throttle.ParseRate.
+func getEnvVarAsRate(name string, defaultValue int64) int64 {
+	valueString := getEnvVarAsString(name, "")
+	if value, err := throttle.ParseRate(valueString); err == nil && valueString != "" {
+		return value
+	}
+	return defaultValue
+}
+
 func getEnvVarAsSlice(name string, defaultValue []string, sep string) []string {
 	valueString := getEnvVarAsString(name, "")
 	if valueString == "" {
@@ -0,0 +1,102 @@
+package output
+
+import (
+	"clickhouse-tools/internal/helper"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Document is the only thing written to stdout in the json format. Field
+// names are stable, the result depends on the command.
+type Document struct {
+	Command         string      `json:"command"`
+	Success         bool        `json:"success"`
+	Error           string      `json:"error,omitempty"`
+	DurationSeconds float64     `json:"duration_seconds"`
+	Result          interface{} `json:"result,omitempty"`
+}
+
+var (
+	format           = FormatText
+	stdout io.Writer = os.Stdout
+	result interface{}
+	// written is set once the document of the command is written.
+	written bool
+)
+
+// Init switches the format. In the json format the human-readable messages
+// are moved to stderr without colours, so stdout only gets the document.
+func Init(outputFormat string) error {
+	switch outputFormat {
+	case FormatText:
+	case FormatJSON:
+		stdout = os.Stdout
+		os.Stdout = os.Stderr
+		helper.DisableColors()
+	default:
+		err := fmt.Errorf("unsupported output '%s', supported: '%s', '%s'", outputFormat, FormatText, FormatJSON)
+		log.Errorf("%+v", err)
+		return err
+	}
+	format, result, written = outputFormat, nil, false
+	return nil
+}
+
+func IsJSON() bool {
+	return format == FormatJSON
+}
+
+// SetResult sets the result of the running command.
+func SetResult(commandResult interface{}) {
+	result = commandResult
+}
+
+// Write prints the document of a finished command in the json format.
+func Write(command string, err error, duration time.Duration) {
+	if !IsJSON() {
+		return
+	}
+	document := Document{
+		Command:         command,
+		Success:         err == nil,
+		DurationSeconds: duration.Seconds(),
+		Result:          result,
+	}
+	if err != nil {
+		document.Error = err.Error()
+	}
+	written = true
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
+
+// WriteUnreported writes the failed document of a command stopped before its
+// action reported it, by a usage error or a failed flag.
+func WriteUnreported(command string, err error) {
+	if err != nil && !written {
+		Write(command, err, 0)
+	}
+}
+
+// UsageError returns the error of wrong arguments of the command. In the text
+// format the help of the command is shown, the json document reports it.
+func UsageError(c *cli.Context, err error) error {
+	log.Errorf("%+v", err)
+	if !IsJSON() {
+		_ = cli.ShowCommandHelp(c, c.Command.Name)
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package remote
+
+import (
+	"bytes"
+	"clickhouse-tools/internal/service/output"
+	"clickhouse-tools/internal/service/sshclient"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"strings"
+)
+
+// Config is the ssh access to the other hosts of a cluster, each of them
+// running clickhouse-tools at ToolPath with its own .env.
+type Config struct {
+	Username, Password, KeyPath, KnownHostsPath, ToolPath string
+	Port                                                  int
+	InsecureIgnoreHostKey                                 bool
+}
+
+// Agent runs clickhouse-tools commands and copies backups on cluster hosts.
+type Agent struct {
+	config *Config
+}
+
+func New(conf *Config) *Agent {
+	return &Agent{
+		config: conf,
+	}
+}
+
+// Run runs the command of clickhouse-tools on the host with the json output
+// and decodes the result of its document into result, when it isn't nil. The
+// first argument is the command name, the global output flag precedes it.
+func (agent *Agent) Run(host string, result interface{}, args ...string) error {
+	client, err := agent.connect(host)
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
+	session, err := client.NewSession()
+	if err != nil {
+		log.Errorf("can't open ssh session on '%s': %v", host, err)
+		return err
+	}
+	defer func(session *ssh.Session) {
+		if err := session.Close(); err != nil && !errors.Is(err, io.EOF) {
+			log.Errorf("%+v", err)
+		}
+	}(session)
+	command := append([]string{agent.config.ToolPath, "--output", output.FormatJSON}, args...)
+	var stdout, stderr bytes.Buffer
+	session.Stdout, session.Stderr = &stdout, &stderr
+	runErr := session.Run(quote(command))
+	var document struct {
+		output.Document
+		Result json.RawMessage `json:"result,omitempty"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &document); err != nil {
+		if runErr == nil {
+			runErr = err
+		}
+		err := fmt.Errorf("'%s' failed on '%s': %v: %s", strings.Join(args, " "), host, runErr, strings.TrimSpace(stderr.String()))
+		log.Errorf("%+v", err)
+		return err
+	}
+	if !document.Success {
+		err := fmt.Errorf("'%s' failed on '%s': %s", strings.Join(args, " "), host, document.Error)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if result != nil && len(document.Result) > 0 {
+		if err := json.Unmarshal(document.Result, result); err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch copies the file from the host to the local path.
+func (agent *Agent) Fetch(host, remotePath, localPath string) error {
+	client, err := agent.connect(host)
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		log.Errorf("can't start sftp subsystem on '%s': %v", host, err)
+		return err
+	}
+	defer closeSftp(sftpClient)
+	remoteFile, err := sftpClient.Open(remotePath)
+	if err != nil {
+		log.Errorf("can't open '%s' on '%s': %v", remotePath, host, err)
+		return err
+	}
+	defer func(remoteFile *sftp.File) {
+		if err := remoteFile.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(remoteFile)
+	file, err := os.Create(localPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if _, err := remoteFile.WriteTo(file); err != nil {
+		log.Errorf("%+v", err)
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+// Send copies the local file to the host.
+func (agent *Agent) Send(host, localPath, remotePath string) error {
+	client, err := agent.connect(host)
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		log.Errorf("can't start sftp subsystem on '%s': %v", host, err)
+		return err
+	}
+	defer closeSftp(sftpClient)
+	file, err := os.Open(localPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	remoteFile, err := sftpClient.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		log.Errorf("can't create '%s' on '%s': %v", remotePath, host, err)
+		return err
+	}
+	if _, err := remoteFile.ReadFrom(file); err != nil {
+		log.Errorf("%+v", err)
+		_ = remoteFile.Close()
+		return err
+	}
+	if err := remoteFile.Close(); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+// Remove removes the file on the host.
+func (agent *Agent) Remove(host, remotePath string) error {
+	client, err := agent.connect(host)
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		log.Errorf("can't start sftp subsystem on '%s': %v", host, err)
+		return err
+	}
+	defer closeSftp(sftpClient)
+	if err := sftpClient.Remove(remotePath); err != nil {
+		log.Errorf("can't remove '%s' on '%s': %v", remotePath, host, err)
+		return err
+	}
+	return nil
+}
+
+func (agent *Agent) connect(host string) (*ssh.Client, error) {
+	return sshclient.Dial(&sshclient.Config{
+		Username:              agent.config.Username,
+		Password:              agent.config.Password,
+		KeyPath:               agent.config.KeyPath,
+		KnownHostsPath:        agent.config.KnownHostsPath,
+		Port:                  agent.config.Port,
+		InsecureIgnoreHostKey: agent.config.InsecureIgnoreHostKey,
+	}, host)
+}
+
+// quote joins the command for the remote shell.
+func quote(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func closeClient(client *ssh.Client) {
+	if err := client.Close(); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
+
+func closeSftp(sftpClient *sftp.Client) {
+	if err := sftpClient.Close(); err != nil && !errors.Is(err, io.EOF) {
+		log.Errorf("%+v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package sshclient
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config is the ssh access to a host by a key or a password, the host key is
+// checked against the known hosts unless it is explicitly ignored.
+type Config struct {
+	Username, Password, KeyPath, KnownHostsPath string
+	Port                                        int
+	InsecureIgnoreHostKey                       bool
+}
+
+// Dial connects to the host on the configured port.
+func Dial(conf *Config, host string) (*ssh.Client, error) {
+	clientConfig, err := ClientConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(conf.Port))
+	client, err := ssh.Dial("tcp", address, clientConfig)
+	if err != nil {
+		log.Errorf("can't connect to '%s': %v", address, err)
+		return nil, err
+	}
+	return client, nil
+}
+
+// ClientConfig authenticates by the key and the password, whichever are set.
+func ClientConfig(conf *Config) (*ssh.ClientConfig, error) {
+	var authMethods []ssh.AuthMethod
+	if conf.KeyPath != "" {
+		key, err := os.ReadFile(conf.KeyPath)
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Errorf("can't parse ssh key '%s': %v", conf.KeyPath, err)
+			return nil, err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		authMethods = append(authMethods, ssh.Password(conf.Password))
+	}
+	if len(authMethods) == 0 {
+		err := errors.New("ssh key path or password must be defined")
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !conf.InsecureIgnoreHostKey {
+		var err error
+		hostKeyCallback, err = knownhosts.New(conf.KnownHostsPath)
+		if err != nil {
+			log.Errorf("can't load known hosts '%s': %v", conf.KnownHostsPath, err)
+			return nil, err
+		}
+	}
+	return &ssh.ClientConfig{
+		User:            conf.Username,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
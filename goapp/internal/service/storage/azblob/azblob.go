@@ -0,0 +1,315 @@
+package azblob
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
+	"clickhouse-tools/pkg/progress"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	Name      = "azblob"
+	maxBlocks = 50000
+)
+
+type Config struct {
+	AccountName, AccountKey, SASToken, Endpoint, Container, Prefix string
+	BlockSize                                                      int64
+	Concurrency                                                    int
+}
+
+type Storage struct {
+	config   *Config
+	checksum string
+}
+
+func New(conf *Config) *Storage {
+	return &Storage{
+		config: conf,
+	}
+}
+
+func (s *Storage) Upload(src string) error {
+	fmt.Print("Upload backup by azblob...")
+	file, err := os.Open(src)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	fileStat, err := file.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	checksum, err := types.UploadChecksum(src, s.checksum)
+	s.checksum = ""
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	uploadProgress := progress.Start("upload", fileStat.Size())
+	err = s.upload(fileStat.Name(), uploadProgress.Reader(file), fileStat.Size(), checksum)
+	uploadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) UploadStream(backupName string, reader io.Reader, size int64) error {
+	fmt.Print("Upload backup by azblob...")
+	checksum := s.checksum
+	s.checksum = ""
+	uploadProgress := progress.Start("upload", size)
+	err := s.upload(backupName, uploadProgress.Reader(reader), size, checksum)
+	uploadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// upload stages the blocks of AZBLOB_BLOCK_SIZE in AZBLOB_CONCURRENCY workers
+// and commits them as the block blob with the checksum in its metadata. The
+// block size grows when the backup doesn't fit in the blocks limit of a blob.
+// Azure doesn't compute the MD5 of a blob committed from blocks, so it's
+// hashed while uploading and set to the blob properties afterwards.
+func (s *Storage) upload(backupName string, reader io.Reader, size int64, checksum string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	blockSize := s.config.BlockSize
+	if blockSize <= 0 || size/blockSize >= maxBlocks {
+		blockSize = size/maxBlocks + 1
+	}
+	options := &blockblob.UploadStreamOptions{
+		BlockSize:   blockSize,
+		Concurrency: s.config.Concurrency,
+	}
+	if checksum != "" {
+		options.Metadata = map[string]*string{types.ChecksumKey: &checksum}
+	}
+	blobClient := client.NewBlockBlobClient(s.blobName(backupName))
+	hash := md5.New()
+	_, err = blobClient.UploadStream(context.Background(), io.TeeReader(reader, hash), options)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	contentType := "application/octet-stream"
+	_, err = blobClient.SetHTTPHeaders(context.Background(), blob.HTTPHeaders{
+		BlobContentType: &contentType,
+		BlobContentMD5:  hash.Sum(nil),
+	}, nil)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.blobName("")
+	pager := client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		if page.Segment == nil {
+			continue
+		}
+		// Sub-directories are reported as the blob prefixes and skipped.
+		for _, blob := range page.Segment.BlobItems {
+			if blob.Name == nil || blob.Properties == nil {
+				continue
+			}
+			name := strings.TrimPrefix(*blob.Name, prefix)
+			if name == "" {
+				continue
+			}
+			var size int64
+			if blob.Properties.ContentLength != nil {
+				size = *blob.Properties.ContentLength
+			}
+			var date time.Time
+			if blob.Properties.LastModified != nil {
+				date = *blob.Properties.LastModified
+			}
+			backup := types.NewBackupInfo(name, size, date)
+			backup.MD5 = hex.EncodeToString(blob.Properties.ContentMD5)
+			backupList = append(backupList, backup)
+		}
+	}
+	return backupList, nil
+}
+
+func (s *Storage) Download(destination, backupName string) error {
+	fmt.Print("Download backup from azblob...")
+	reader, size, err := s.open(backupName)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(reader io.ReadCloser) {
+		if err := reader.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(reader)
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	downloadProgress := progress.Start("download", size)
+	_, err = io.Copy(downloadProgress.Writer(file), reader)
+	downloadProgress.Finish()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) DownloadStream(backupName string) (io.ReadCloser, error) {
+	reader, _, err := s.open(backupName)
+	return reader, err
+}
+
+// open returns the body of the blob and its size.
+func (s *Storage) open(backupName string) (io.ReadCloser, int64, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := client.NewBlobClient(s.blobName(backupName)).DownloadStream(context.Background(), nil)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, 0, err
+	}
+	var size int64
+	if response.ContentLength != nil {
+		size = *response.ContentLength
+	}
+	return response.Body, size, nil
+}
+
+func (s *Storage) Delete(backupName string) error {
+	fmt.Print("Delete backup from azblob...")
+	client, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if _, err := client.NewBlobClient(s.blobName(backupName)).Delete(context.Background(), nil); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) SetChecksum(checksum string) {
+	s.checksum = checksum
+}
+
+// Checksum returns the checksum recorded in the blob metadata, empty for
+// backups uploaded without it. The metadata names come back in the case of
+// the response headers, so they are compared case-insensitively.
+func (s *Storage) Checksum(backupName string) (string, error) {
+	client, err := s.connect()
+	if err != nil {
+		return "", err
+	}
+	properties, err := client.NewBlobClient(s.blobName(backupName)).GetProperties(context.Background(), nil)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	for name, value := range properties.Metadata {
+		if strings.EqualFold(name, types.ChecksumKey) && value != nil {
+			return *value, nil
+		}
+	}
+	return "", nil
+}
+
+// connect creates the client of the container authorized by the SAS token
+// appended to the container url, or by the account key without the token.
+func (s *Storage) connect() (*container.Client, error) {
+	endpoint := s.config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.config.AccountName)
+	}
+	containerUrl := strings.TrimSuffix(endpoint, "/") + "/" + s.config.Container
+	var (
+		client *container.Client
+		err    error
+	)
+	if s.config.SASToken != "" {
+		client, err = container.NewClientWithNoCredential(containerUrl+"?"+strings.TrimPrefix(s.config.SASToken, "?"), nil)
+	} else if s.config.AccountKey != "" {
+		var credential *azblob.SharedKeyCredential
+		credential, err = azblob.NewSharedKeyCredential(s.config.AccountName, s.config.AccountKey)
+		if err == nil {
+			client, err = container.NewClientWithSharedKeyCredential(containerUrl, credential, nil)
+		}
+	} else {
+		err = errors.New("azblob account key or SAS token must be defined")
+	}
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s *Storage) blobName(backupName string) string {
+	prefix := strings.Trim(s.config.Prefix, "/")
+	if prefix == "" {
+		return backupName
+	}
+	return prefix + "/" + backupName
+}
@@ -0,0 +1,338 @@
+package azblob
+
+import (
+	"bytes"
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/encryptor"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	accountName = "devstoreaccount1"
+	accountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type fakeBlob struct {
+	content  []byte
+	md5      []byte
+	metadata map[string]string
+	modified time.Time
+}
+
+// fakeService serves the Blob service requests of the storage for the
+// container "bucket" of the account, path-style like Azurite.
+type fakeService struct {
+	mu            sync.Mutex
+	blobs         map[string]*fakeBlob
+	blocks        map[string][]byte
+	authorization map[string]bool
+}
+
+type listResult struct {
+	XMLName  xml.Name   `xml:"EnumerationResults"`
+	Blobs    []listBlob `xml:"Blobs>Blob"`
+	Prefixes []string   `xml:"Blobs>BlobPrefix>Name"`
+}
+
+type listBlob struct {
+	Name          string `xml:"Name"`
+	LastModified  string `xml:"Properties>Last-Modified"`
+	ContentLength int64  `xml:"Properties>Content-Length"`
+	ContentMD5    string `xml:"Properties>Content-MD5,omitempty"`
+	BlobType      string `xml:"Properties>BlobType"`
+}
+
+func newFakeService(t *testing.T, blobs map[string][]byte) (*fakeService, *httptest.Server) {
+	service := &fakeService{
+		blobs:         map[string]*fakeBlob{},
+		blocks:        map[string][]byte{},
+		authorization: map[string]bool{},
+	}
+	for name, content := range blobs {
+		sum := md5.Sum(content)
+		service.blobs[name] = &fakeBlob{content: content, md5: sum[:], modified: time.Now()}
+	}
+	server := httptest.NewServer(service)
+	t.Cleanup(server.Close)
+	return service, server
+}
+
+func (service *fakeService) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	authorization := "sas"
+	if header := request.Header.Get("Authorization"); header != "" {
+		authorization = strings.SplitN(header, ":", 2)[0]
+	} else if request.URL.Query().Get("sig") == "" {
+		authorization = "anonymous"
+	}
+	service.authorization[authorization] = true
+	containerPath := "/" + accountName + "/bucket"
+	if !strings.HasPrefix(request.URL.Path, containerPath) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, containerPath), "/")
+	query := request.URL.Query()
+	body, _ := io.ReadAll(request.Body)
+	blob := service.blobs[name]
+	switch {
+	case request.Method == http.MethodGet && query.Get("comp") == "list":
+		service.list(writer, query.Get("prefix"), query.Get("delimiter"))
+	case request.Method == http.MethodPut && query.Get("comp") == "block":
+		service.blocks[name+"/"+query.Get("blockid")] = body
+		writer.WriteHeader(http.StatusCreated)
+	case request.Method == http.MethodPut && (query.Get("comp") == "blocklist" || query.Get("comp") == ""):
+		blob := &fakeBlob{metadata: map[string]string{}, modified: time.Now()}
+		if query.Get("comp") == "" {
+			// Put Blob computes the MD5 of the content, Put Block List doesn't.
+			sum := md5.Sum(body)
+			blob.content, blob.md5 = body, sum[:]
+		} else {
+			var blockList struct {
+				Latest []string `xml:"Latest"`
+			}
+			if err := xml.Unmarshal(body, &blockList); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			for _, id := range blockList.Latest {
+				blob.content = append(blob.content, service.blocks[name+"/"+id]...)
+			}
+		}
+		for header := range request.Header {
+			if metadataName, ok := strings.CutPrefix(strings.ToLower(header), "x-ms-meta-"); ok {
+				blob.metadata[metadataName] = request.Header.Get(header)
+			}
+		}
+		service.blobs[name] = blob
+		writer.WriteHeader(http.StatusCreated)
+	case blob == nil:
+		writer.Header().Set("x-ms-error-code", "BlobNotFound")
+		writer.WriteHeader(http.StatusNotFound)
+	case request.Method == http.MethodPut && query.Get("comp") == "properties":
+		blob.md5, _ = base64.StdEncoding.DecodeString(request.Header.Get("x-ms-blob-content-md5"))
+		writer.WriteHeader(http.StatusOK)
+	case request.Method == http.MethodGet || request.Method == http.MethodHead:
+		writer.Header().Set("Content-Length", strconv.Itoa(len(blob.content)))
+		writer.Header().Set("Last-Modified", blob.modified.UTC().Format(http.TimeFormat))
+		writer.Header().Set("ETag", `"etag"`)
+		writer.Header().Set("x-ms-blob-type", "BlockBlob")
+		for metadataName, value := range blob.metadata {
+			writer.Header().Set("x-ms-meta-"+metadataName, value)
+		}
+		writer.WriteHeader(http.StatusOK)
+		if request.Method == http.MethodGet {
+			_, _ = writer.Write(blob.content)
+		}
+	case request.Method == http.MethodDelete:
+		delete(service.blobs, name)
+		writer.WriteHeader(http.StatusAccepted)
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (service *fakeService) list(writer http.ResponseWriter, prefix, delimiter string) {
+	result := listResult{}
+	prefixes := map[string]bool{}
+	var names []string
+	for name := range service.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		if index := strings.Index(rest, delimiter); delimiter != "" && index >= 0 {
+			blobPrefix := prefix + rest[:index+1]
+			if !prefixes[blobPrefix] {
+				prefixes[blobPrefix] = true
+				result.Prefixes = append(result.Prefixes, blobPrefix)
+			}
+			continue
+		}
+		blob := service.blobs[name]
+		item := listBlob{
+			Name:          name,
+			LastModified:  blob.modified.UTC().Format(http.TimeFormat),
+			ContentLength: int64(len(blob.content)),
+			BlobType:      "BlockBlob",
+		}
+		if blob.md5 != nil {
+			item.ContentMD5 = base64.StdEncoding.EncodeToString(blob.md5)
+		}
+		result.Blobs = append(result.Blobs, item)
+	}
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(writer).Encode(result)
+}
+
+func newStorage(server *httptest.Server) *Storage {
+	return New(&Config{
+		AccountName: accountName,
+		AccountKey:  accountKey,
+		Endpoint:    server.URL + "/" + accountName,
+		Container:   "bucket",
+		Prefix:      "Backup",
+		BlockSize:   1024 * 1024,
+		Concurrency: 2,
+	})
+}
+
+func writeBackup(t *testing.T, size int) (string, []byte) {
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "db_2024-01-02T03-04-05.tar.lz4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return src, content
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "single block", size: 1000},
+		{name: "several blocks", size: 3*1024*1024 + 1000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, server := newFakeService(t, nil)
+			src, content := writeBackup(t, test.size)
+			storage := newStorage(server)
+			if err := storage.Upload(src); err != nil {
+				t.Fatal(err)
+			}
+			blob := service.blobs["Backup/"+filepath.Base(src)]
+			if blob == nil || !bytes.Equal(blob.content, content) {
+				t.Fatal("uploaded blob differs from the backup")
+			}
+			if !service.authorization["SharedKey "+accountName] || len(service.authorization) != 1 {
+				t.Fatalf("expected requests signed by the account key, got %v", service.authorization)
+			}
+			backups, err := storage.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md5 := fmt.Sprintf("%x", md5.Sum(content)); len(backups) != 1 || backups[0].MD5 != md5 {
+				t.Fatalf("expected a backup with md5 %s, got %+v", md5, backups)
+			}
+		})
+	}
+}
+
+func TestSASToken(t *testing.T) {
+	service, server := newFakeService(t, map[string][]byte{"Backup/db_1.tar.lz4": []byte("backup")})
+	storage := newStorage(server)
+	storage.config.SASToken = "?sv=2021-08-06&ss=b&srt=sco&sp=rl&sig=signature"
+	backups, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	if !service.authorization["sas"] || len(service.authorization) != 1 {
+		t.Fatalf("expected requests authorized by the SAS token, got %v", service.authorization)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	_, server := newFakeService(t, nil)
+	storage := newStorage(server)
+	src, _ := writeBackup(t, 1000)
+	if err := storage.Upload(src); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := helper.FileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := storage.Checksum(filepath.Base(src))
+	if err != nil || checksum != expected {
+		t.Fatalf("expected checksum %s, got %q (%v)", expected, checksum, err)
+	}
+	// The checksum set for an encrypted file is recorded instead of its own.
+	encSrc := src + encryptor.Extension
+	if err := os.Rename(src, encSrc); err != nil {
+		t.Fatal(err)
+	}
+	storage.SetChecksum("plain")
+	if err := storage.Upload(encSrc); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum(filepath.Base(encSrc)); err != nil || checksum != "plain" {
+		t.Fatalf("expected the set checksum, got %q (%v)", checksum, err)
+	}
+	if err := storage.UploadStream("db_1.tar.lz4", strings.NewReader("backup"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum("db_1.tar.lz4"); err != nil || checksum != "" {
+		t.Fatalf("expected no checksum of a stream, got %q (%v)", checksum, err)
+	}
+	storage.SetChecksum("copied")
+	if err := storage.UploadStream("db_2.tar.lz4", strings.NewReader("backup"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum("db_2.tar.lz4"); err != nil || checksum != "copied" {
+		t.Fatalf("expected the set checksum of a stream, got %q (%v)", checksum, err)
+	}
+}
+
+func TestListDownloadDelete(t *testing.T) {
+	service, server := newFakeService(t, map[string][]byte{
+		"Backup/db_1.tar.lz4":        []byte("backup"),
+		"Backup/nested/db_2.tar.lz4": []byte("nested"),
+		"Other/db_3.tar.lz4":         []byte("other"),
+	})
+	storage := newStorage(server)
+	backups, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "db_1.tar.lz4" || backups[0].Size != 6 {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	if md5 := fmt.Sprintf("%x", md5.Sum([]byte("backup"))); backups[0].MD5 != md5 {
+		t.Fatalf("expected md5 %s, got %q", md5, backups[0].MD5)
+	}
+	destination := filepath.Join(t.TempDir(), "db_1.tar.lz4")
+	if err := storage.Download(destination, "db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(destination); string(content) != "backup" {
+		t.Fatalf("unexpected downloaded content %q", content)
+	}
+	if err := storage.Delete("db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.blobs["Backup/db_1.tar.lz4"]; ok {
+		t.Fatal("backup is not deleted")
+	}
+	if err := storage.Delete("db_1.tar.lz4"); err == nil {
+		t.Fatal("expected an error deleting a missing backup")
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/encryptor"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+type EncryptedStorage struct {
+	storage   Interface
+	encryptor *encryptor.Encryptor
+	resume    bool
+}
+
+func NewEncrypted(storage Interface, encryptor *encryptor.Encryptor) *EncryptedStorage {
+	return &EncryptedStorage{
+		storage:   storage,
+		encryptor: encryptor,
+	}
+}
+
+func (s *EncryptedStorage) SetResume(resume bool) {
+	s.resume = resume
+	if storage, ok := s.storage.(Resumable); ok {
+		storage.SetResume(resume)
+	}
+}
+
+func (s *EncryptedStorage) Unwrap() Interface {
+	return s.storage
+}
+
+// Upload encrypts the backup before uploading it. On resume the encrypted file
+// left by the interrupted upload is reused, because a new encryption produces
+// different bytes and the already uploaded parts would not match. Checksummed
+// storages record the checksum of the plain backup.
+func (s *EncryptedStorage) Upload(src string) error {
+	if checksummed, ok := s.storage.(Checksummed); ok {
+		checksum, err := helper.FileSHA256(src)
+		if err != nil {
+			return err
+		}
+		checksummed.SetChecksum(checksum)
+	}
+	encSrc := src + encryptor.Extension
+	if _, err := os.Stat(encSrc); err != nil || !s.resume {
+		fmt.Print("Encrypt backup...")
+		if encSrc, err = s.encryptor.EncryptFile(src); err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+		helper.ColoredPrintln(helper.ColorGreen, "done!")
+	}
+	if err := s.storage.Upload(encSrc); err != nil {
+		if _, ok := s.storage.(Resumable); !ok {
+			removeFile(encSrc)
+		}
+		return err
+	}
+	removeFile(encSrc)
+	return nil
+}
+
+func (s *EncryptedStorage) List() ([]BackupInfo, error) {
+	return s.storage.List()
+}
+
+// Download decrypts backups stored with the encryptor extension and leaves
+// plain backups, uploaded before encryption was enabled, as they are.
+func (s *EncryptedStorage) Download(destination, backupName string) error {
+	if !strings.HasSuffix(backupName, encryptor.Extension) {
+		return s.storage.Download(destination, backupName)
+	}
+	if err := s.storage.Download(destination, backupName); err != nil {
+		return err
+	}
+	fmt.Print("Decrypt backup...")
+	if _, err := s.encryptor.DecryptFile(destination); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if err := os.Remove(destination); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *EncryptedStorage) Delete(backupName string) error {
+	return s.storage.Delete(backupName)
+}
+
+func removeFile(filePath string) {
+	if err := os.Remove(filePath); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package gcs
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
+	"clickhouse-tools/pkg/progress"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	Name            = "gcs"
+	DefaultEndpoint = "https://storage.googleapis.com"
+)
+
+type Config struct {
+	Bucket, Directory, Endpoint, CredentialsFile string
+	ChunkSize                                    int64
+}
+
+type Storage struct {
+	config   *Config
+	checksum string
+}
+
+// streamReader closes the client of the stream with it.
+type streamReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func New(conf *Config) *Storage {
+	return &Storage{
+		config: conf,
+	}
+}
+
+func (s *Storage) Upload(src string) error {
+	fmt.Print("Upload backup by gcs...")
+	file, err := os.Open(src)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	fileStat, err := file.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	checksum, err := types.UploadChecksum(src, s.checksum)
+	s.checksum = ""
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	uploadProgress := progress.Start("upload", fileStat.Size())
+	err = s.upload(fileStat.Name(), uploadProgress.Reader(file), checksum)
+	uploadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) UploadStream(backupName string, reader io.Reader, size int64) error {
+	fmt.Print("Upload backup by gcs...")
+	checksum := s.checksum
+	s.checksum = ""
+	uploadProgress := progress.Start("upload", size)
+	err := s.upload(backupName, uploadProgress.Reader(reader), checksum)
+	uploadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// upload writes the object by a resumable upload of GCS_CHUNK_SIZE chunks
+// with the checksum in its metadata. Failed chunks are retried by the client,
+// a backup is written once under its name, so retries are safe.
+func (s *Storage) upload(backupName string, reader io.Reader, checksum string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer closeClient(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	object := client.Bucket(s.config.Bucket).Object(s.objectName(backupName)).Retryer(storage.WithPolicy(storage.RetryAlways))
+	writer := object.NewWriter(ctx)
+	writer.ChunkSize = int(s.config.ChunkSize)
+	if checksum != "" {
+		writer.Metadata = map[string]string{types.ChecksumKey: checksum}
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		// Cancelling the context aborts the upload.
+		cancel()
+		_ = writer.Close()
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient(client)
+	prefix := s.objectName("")
+	query := &storage.Query{Prefix: prefix, Delimiter: "/"}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Updated", "MD5"}); err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	objects := client.Bucket(s.config.Bucket).Objects(context.Background(), query)
+	for {
+		attrs, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		// Sub-directories are reported by their prefixes without names.
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		if attrs.Name == "" || name == "" {
+			continue
+		}
+		backup := types.NewBackupInfo(name, attrs.Size, attrs.Updated)
+		backup.MD5 = hex.EncodeToString(attrs.MD5)
+		backupList = append(backupList, backup)
+	}
+	return backupList, nil
+}
+
+func (s *Storage) Download(destination, backupName string) error {
+	fmt.Print("Download backup from gcs...")
+	reader, err := s.open(backupName)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(reader *streamReader) {
+		if err := reader.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(reader)
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	downloadProgress := progress.Start("download", reader.Attrs.Size)
+	_, err = io.Copy(downloadProgress.Writer(file), reader)
+	downloadProgress.Finish()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) DownloadStream(backupName string) (io.ReadCloser, error) {
+	return s.open(backupName)
+}
+
+// open returns the reader of the object, closing it closes the client.
+func (s *Storage) open(backupName string) (*streamReader, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := client.Bucket(s.config.Bucket).Object(s.objectName(backupName)).NewReader(context.Background())
+	if err != nil {
+		log.Errorf("%+v", err)
+		closeClient(client)
+		return nil, err
+	}
+	return &streamReader{Reader: reader, client: client}, nil
+}
+
+func (s *Storage) Delete(backupName string) error {
+	fmt.Print("Delete backup from gcs...")
+	client, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer closeClient(client)
+	if err := client.Bucket(s.config.Bucket).Object(s.objectName(backupName)).Delete(context.Background()); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) SetChecksum(checksum string) {
+	s.checksum = checksum
+}
+
+// Checksum returns the checksum recorded in the object metadata, empty for
+// backups uploaded without it.
+func (s *Storage) Checksum(backupName string) (string, error) {
+	client, err := s.connect()
+	if err != nil {
+		return "", err
+	}
+	defer closeClient(client)
+	attrs, err := client.Bucket(s.config.Bucket).Object(s.objectName(backupName)).Attrs(context.Background())
+	if err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	return attrs.Metadata[types.ChecksumKey], nil
+}
+
+// connect creates a client of the JSON API authorized by the service account
+// key of GCS_CREDENTIALS_FILE. Without the key the requests are anonymous,
+// e.g. to a local fake-gcs-server.
+func (s *Storage) connect() (*storage.Client, error) {
+	options := []option.ClientOption{storage.WithJSONReads()}
+	if s.config.Endpoint != "" && s.config.Endpoint != DefaultEndpoint {
+		options = append(options, option.WithEndpoint(strings.TrimSuffix(s.config.Endpoint, "/")+"/storage/v1/"))
+	}
+	if s.config.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(s.config.CredentialsFile))
+	} else {
+		options = append(options, option.WithoutAuthentication())
+	}
+	client, err := storage.NewClient(context.Background(), options...)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s *Storage) objectName(backupName string) string {
+	directory := strings.Trim(s.config.Directory, "/")
+	if directory == "" {
+		return backupName
+	}
+	return directory + "/" + backupName
+}
+
+func closeClient(client *storage.Client) {
+	if err := client.Close(); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
+
+func (reader *streamReader) Close() error {
+	err := reader.Reader.Close()
+	closeClient(reader.client)
+	return err
+}
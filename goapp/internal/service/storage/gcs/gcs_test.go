@@ -0,0 +1,163 @@
+package gcs
+
+import (
+	"bytes"
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/encryptor"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeServer starts a fake-gcs-server with the bucket of the objects.
+func newFakeServer(t *testing.T, objects map[string][]byte) *fakestorage.Server {
+	initialObjects := []fakestorage.Object{}
+	for name, content := range objects {
+		initialObjects = append(initialObjects, fakestorage.Object{
+			ObjectAttrs: fakestorage.ObjectAttrs{BucketName: "bucket", Name: name},
+			Content:     content,
+		})
+	}
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		InitialObjects: initialObjects,
+		Scheme:         "http",
+		Host:           "127.0.0.1",
+		Writer:         io.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "bucket"})
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func newStorage(server *fakestorage.Server) *Storage {
+	return New(&Config{
+		Bucket:    "bucket",
+		Directory: "Backup",
+		Endpoint:  server.URL(),
+		ChunkSize: 256 * 1024,
+	})
+}
+
+func writeBackup(t *testing.T, size int) (string, []byte) {
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "db_2024-01-02T03-04-05.tar.lz4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return src, content
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "single request", size: 1000},
+		{name: "resumable upload of several chunks", size: 3*256*1024 + 1000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeServer(t, nil)
+			src, content := writeBackup(t, test.size)
+			if err := newStorage(server).Upload(src); err != nil {
+				t.Fatal(err)
+			}
+			object, err := server.GetObject("bucket", "Backup/"+filepath.Base(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(object.Content, content) {
+				t.Fatal("uploaded object differs from the backup")
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	server := newFakeServer(t, nil)
+	storage := newStorage(server)
+	src, _ := writeBackup(t, 1000)
+	if err := storage.Upload(src); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := helper.FileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := storage.Checksum(filepath.Base(src))
+	if err != nil || checksum != expected {
+		t.Fatalf("expected checksum %s, got %q (%v)", expected, checksum, err)
+	}
+	// The checksum set for an encrypted file is recorded instead of its own.
+	encSrc := src + encryptor.Extension
+	if err := os.Rename(src, encSrc); err != nil {
+		t.Fatal(err)
+	}
+	storage.SetChecksum("plain")
+	if err := storage.Upload(encSrc); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum(filepath.Base(encSrc)); err != nil || checksum != "plain" {
+		t.Fatalf("expected the set checksum, got %q (%v)", checksum, err)
+	}
+	if err := storage.UploadStream("db_1.tar.lz4", strings.NewReader("backup"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum("db_1.tar.lz4"); err != nil || checksum != "" {
+		t.Fatalf("expected no checksum of a stream, got %q (%v)", checksum, err)
+	}
+	storage.SetChecksum("copied")
+	if err := storage.UploadStream("db_2.tar.lz4", strings.NewReader("backup"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := storage.Checksum("db_2.tar.lz4"); err != nil || checksum != "copied" {
+		t.Fatalf("expected the set checksum of a stream, got %q (%v)", checksum, err)
+	}
+}
+
+func TestListDownloadDelete(t *testing.T) {
+	server := newFakeServer(t, map[string][]byte{
+		"Backup/db_1.tar.lz4":        []byte("backup"),
+		"Backup/nested/db_2.tar.lz4": []byte("nested"),
+		"Other/db_3.tar.lz4":         []byte("other"),
+	})
+	storage := newStorage(server)
+	backups, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "db_1.tar.lz4" || backups[0].Size != 6 {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	if md5 := fmt.Sprintf("%x", md5.Sum([]byte("backup"))); backups[0].MD5 != md5 {
+		t.Fatalf("expected md5 %s, got %q", md5, backups[0].MD5)
+	}
+	destination := filepath.Join(t.TempDir(), "db_1.tar.lz4")
+	if err := storage.Download(destination, "db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(destination); string(content) != "backup" {
+		t.Fatalf("unexpected downloaded content %q", content)
+	}
+	if err := storage.Delete("db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.GetObject("bucket", "Backup/db_1.tar.lz4"); err == nil {
+		t.Fatal("backup is not deleted")
+	}
+	if err := storage.Delete("db_1.tar.lz4"); err == nil {
+		t.Fatal("expected an error deleting a missing backup")
+	}
+}
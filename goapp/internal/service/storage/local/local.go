@@ -0,0 +1,199 @@
+package local
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
+	"clickhouse-tools/pkg/progress"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	Name          = "local"
+	partExtension = ".part"
+)
+
+type Config struct {
+	Path string
+}
+
+type Storage struct {
+	config *Config
+}
+
+func New(conf *Config) *Storage {
+	return &Storage{
+		config: conf,
+	}
+}
+
+// Upload copies the backup next to its final name and renames it only after
+// the data has been flushed, so a partially copied backup never shows up in
+// the list.
+func (s *Storage) Upload(src string) error {
+	fmt.Print("Upload backup by local...")
+	if err := os.MkdirAll(s.config.Path, 0750); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	dstPath := path.Join(s.config.Path, path.Base(src))
+	if err := copyFile(src, dstPath, "upload"); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
+	entries, err := os.ReadDir(s.config.Path)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), partExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backupList = append(backupList, types.NewBackupInfo(entry.Name(), info.Size(), info.ModTime()))
+	}
+	return backupList, nil
+}
+
+func (s *Storage) Download(destination, backupName string) error {
+	fmt.Print("Download backup by local...")
+	if err := copyFile(path.Join(s.config.Path, backupName), destination, "download"); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) UploadStream(backupName string, reader io.Reader, size int64) error {
+	fmt.Print("Upload backup by local...")
+	if err := os.MkdirAll(s.config.Path, 0750); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	uploadProgress := progress.Start("upload", size)
+	err := writeFile(uploadProgress.Reader(reader), path.Join(s.config.Path, backupName))
+	uploadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) DownloadStream(backupName string) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(s.config.Path, backupName))
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *Storage) Delete(backupName string) error {
+	fmt.Print("Delete backup by local...")
+	if err := os.Remove(path.Join(s.config.Path, backupName)); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if err := syncDir(s.config.Path); err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// copyFile reports the progress of the copy as the phase.
+func copyFile(srcPath, dstPath, phase string) error {
+	source, err := os.Open(srcPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(source *os.File) {
+		err := source.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(source)
+	sourceStat, err := source.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	copyProgress := progress.Start(phase, sourceStat.Size())
+	defer copyProgress.Finish()
+	return writeFile(copyProgress.Reader(source), dstPath)
+}
+
+func writeFile(source io.Reader, dstPath string) error {
+	partPath := dstPath + partExtension
+	destination, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		log.Errorf("%+v", err)
+		_ = destination.Close()
+		_ = os.Remove(partPath)
+		return err
+	}
+	if err := destination.Sync(); err != nil {
+		log.Errorf("%+v", err)
+		_ = destination.Close()
+		_ = os.Remove(partPath)
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		log.Errorf("%+v", err)
+		_ = os.Remove(partPath)
+		return err
+	}
+	if err := os.Rename(partPath, dstPath); err != nil {
+		log.Errorf("%+v", err)
+		_ = os.Remove(partPath)
+		return err
+	}
+	return syncDir(path.Dir(dstPath))
+}
+
+// syncDir flushes the directory entry so a rename survives a crash of the host
+// or of the NFS client.
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(dir *os.File) {
+		err := dir.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(dir)
+	if err := dir.Sync(); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
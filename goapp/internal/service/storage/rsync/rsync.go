@@ -3,10 +3,16 @@ package rsync
 import (
 	"bytes"
 	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -14,24 +20,32 @@ const (
 	execCommandTypeUpload     = "upload"
 	execCommandTypeDownload   = "download"
 	execCommandTypeListString = "list_string"
+	execCommandTypeDelete     = "delete"
 )
 
 type Options struct {
-	Archive  bool   `cli_name:"--archive"`
-	Verbose  bool   `cli_name:"--verbose"`
-	Progress bool   `cli_name:"--progress"`
-	ListOnly bool   `cli_name:"--list-only"`
-	Rsh      string `cli_name:"--rsh"`
+	Archive   bool   `cli_name:"--archive"`
+	Verbose   bool   `cli_name:"--verbose"`
+	Progress  bool   `cli_name:"--progress"`
+	ListOnly  bool   `cli_name:"--list-only"`
+	Recursive bool   `cli_name:"--recursive"`
+	Delete    bool   `cli_name:"--delete"`
+	Include   string `cli_name:"--include"`
+	Exclude   string `cli_name:"--exclude"`
+	Rsh       string `cli_name:"--rsh"`
+	BwLimit   string `cli_name:"--bwlimit"`
 }
 
 type Storage struct {
-	config  *Config
-	options *Options
+	config                     *Config
+	uploadLimit, downloadLimit int64
 }
 
 type Config struct {
-	Host, Username, Password, RemotePath, SSHKeyPath string
-	UseSSH                                           bool
+	Host, Username, Password, RemotePath, SSHKeyPath, KnownHostsPath string
+	Port                                                             int
+	UseSSH, InsecureIgnoreHostKey                                    bool
+	BwLimit                                                          int64
 }
 type ExecCommand struct {
 	Type, Source, Destination string
@@ -51,6 +65,21 @@ func getArguments(options *Options) []string {
 	if options.ListOnly {
 		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "ListOnly", "cli_name"))
 	}
+	if options.Recursive {
+		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "Recursive", "cli_name"))
+	}
+	if options.Delete {
+		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "Delete", "cli_name"))
+	}
+	if options.Include != "" {
+		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "Include", "cli_name"), options.Include)
+	}
+	if options.Exclude != "" {
+		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "Exclude", "cli_name"), options.Exclude)
+	}
+	if options.BwLimit != "" {
+		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "BwLimit", "cli_name")+"="+options.BwLimit)
+	}
 	if options.Rsh != "" {
 		arguments = append(arguments, helper.GetAssociatedPropertyName(options, "Rsh", "cli_name"), options.Rsh)
 	}
@@ -59,22 +88,41 @@ func getArguments(options *Options) []string {
 
 func New(conf *Config) *Storage {
 	return &Storage{
-		config: conf,
-		options: &Options{
-			Archive:  false,
-			Verbose:  false,
-			Progress: false,
-			ListOnly: false,
-			Rsh:      fmt.Sprintf("/usr/bin/ssh -i %s -p %d -o StrictHostKeyChecking=no -l %s", conf.SSHKeyPath, 22, "root"),
-		},
+		config:        conf,
+		uploadLimit:   conf.BwLimit,
+		downloadLimit: conf.BwLimit,
 	}
 }
 
+// newOptions builds the options of a single rsync call, so no call inherits
+// the flags of a previous one.
+func (s *Storage) newOptions() *Options {
+	return &Options{Rsh: rsh(s.config)}
+}
+
+// rsh is the ssh transport of the configured user and port, the host key is
+// checked against the known hosts unless it is explicitly ignored.
+func rsh(conf *Config) string {
+	arguments := []string{"/usr/bin/ssh"}
+	if conf.SSHKeyPath != "" {
+		arguments = append(arguments, "-i", conf.SSHKeyPath)
+	}
+	arguments = append(arguments, "-p", strconv.Itoa(conf.Port))
+	if conf.InsecureIgnoreHostKey {
+		arguments = append(arguments, "-o", "StrictHostKeyChecking=no")
+	} else {
+		arguments = append(arguments, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+conf.KnownHostsPath)
+	}
+	return strings.Join(append(arguments, "-l", conf.Username), " ")
+}
+
 func (s *Storage) Upload(src string) error {
 	fmt.Print("Upload backup by rsync...")
-	s.options.Archive = true
-	s.options.Verbose = true
-	_, err := s.exec(&ExecCommand{
+	options := s.newOptions()
+	options.Archive = true
+	options.Verbose = true
+	options.BwLimit = bwLimit(s.uploadLimit)
+	_, err := s.exec(options, &ExecCommand{
 		Type:        execCommandTypeUpload,
 		Source:      src,
 		Destination: fmt.Sprintf("%s:%s", s.config.Host, s.config.RemotePath),
@@ -87,23 +135,67 @@ func (s *Storage) Upload(src string) error {
 	return nil
 }
 
-func (s *Storage) GetBackupListString() (string, error) {
-	s.options.ListOnly = true
-	std, err := s.exec(&ExecCommand{
+// SetRateLimit overrides RSYNC_BWLIMIT, zero keeps a limit as is.
+func (s *Storage) SetRateLimit(upload, download int64) {
+	if upload > 0 {
+		s.uploadLimit = upload
+	}
+	if download > 0 {
+		s.downloadLimit = download
+	}
+}
+
+// bwLimit converts bytes per second to the KiB per second of --bwlimit.
+func bwLimit(limit int64) string {
+	if limit <= 0 {
+		return ""
+	}
+	if limit < 1024 {
+		return "1"
+	}
+	return strconv.FormatInt(limit/1024, 10)
+}
+
+// List parses the `--list-only` output, where every entry looks like
+// "-rw-r--r--    1,234,567 2006/01/02 15:04:05 name".
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
+	options := s.newOptions()
+	options.ListOnly = true
+	std, err := s.exec(options, &ExecCommand{
 		Type:   execCommandTypeListString,
 		Source: fmt.Sprintf("%s:%s", s.config.Host, s.config.RemotePath),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	re := regexp.MustCompile(`(?m)^([-a-zA-Z]{10})\s+([\d,.]+)\s+(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})\s+(.+?)\r?$`)
+	for _, match := range re.FindAllStringSubmatch(std, -1) {
+		if !strings.HasPrefix(match[1], "-") {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(match[2]), 10, 64)
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		date, err := time.ParseInLocation("2006/01/02 15:04:05", match[3], time.Local)
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		backupList = append(backupList, types.NewBackupInfo(match[4], size, date))
 	}
-	return std, nil
+	return backupList, nil
 }
 
 func (s *Storage) Download(destination, backupName string) error {
 	fmt.Print("Download backup by rsync...")
-	s.options.Archive = true
-	s.options.Verbose = true
-	_, err := s.exec(&ExecCommand{
+	options := s.newOptions()
+	options.Archive = true
+	options.Verbose = true
+	options.BwLimit = bwLimit(s.downloadLimit)
+	_, err := s.exec(options, &ExecCommand{
 		Type:        execCommandTypeDownload,
 		Source:      fmt.Sprintf("%s:%s", s.config.Host, path.Join(s.config.RemotePath, backupName)),
 		Destination: destination,
@@ -116,7 +208,41 @@ func (s *Storage) Download(destination, backupName string) error {
 	return nil
 }
 
-func (s *Storage) exec(execCommand *ExecCommand) (string, error) {
+// Delete removes a single backup by syncing an empty directory over the remote
+// path with a filter that only matches the backup, so it works over both
+// ssh and the rsync daemon.
+func (s *Storage) Delete(backupName string) error {
+	fmt.Print("Delete backup by rsync...")
+	emptyDir, err := os.MkdirTemp("", "clickhouse-tools-rsync-")
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(emptyDir string) {
+		if err := os.RemoveAll(emptyDir); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(emptyDir)
+	options := s.newOptions()
+	options.Recursive = true
+	options.Delete = true
+	options.Include = backupName
+	options.Exclude = "*"
+	_, err = s.exec(options, &ExecCommand{
+		Type:        execCommandTypeDelete,
+		Source:      emptyDir + "/",
+		Destination: fmt.Sprintf("%s:%s", s.config.Host, s.config.RemotePath),
+	})
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) exec(rsyncOptions *Options, execCommand *ExecCommand) (string, error) {
 	var (
 		stdout, stderr bytes.Buffer
 		options        []string
@@ -125,10 +251,12 @@ func (s *Storage) exec(execCommand *ExecCommand) (string, error) {
 	case execCommandTypeUpload:
 		fallthrough
 	case execCommandTypeDownload:
-		options = append(getArguments(s.options), execCommand.Source, execCommand.Destination)
+		fallthrough
+	case execCommandTypeDelete:
+		options = append(getArguments(rsyncOptions), execCommand.Source, execCommand.Destination)
 		break
 	case execCommandTypeListString:
-		options = append(getArguments(s.options), execCommand.Source)
+		options = append(getArguments(rsyncOptions), execCommand.Source)
 		break
 	default:
 		err := fmt.Errorf("unsupported exec command type '%s'", execCommand.Type)
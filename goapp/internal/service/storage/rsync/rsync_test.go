@@ -0,0 +1,85 @@
+package rsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRsync logs the arguments of every call, lists a single backup with
+// --list-only and writes the backup to the last argument otherwise.
+const fakeRsync = `#!/bin/sh
+echo "$@" >> "$RSYNC_LOG"
+case " $* " in
+*" --list-only "*)
+	echo "-rw-r--r--              6 2024/01/02 03:04:05 db_2024-01-02T03-04-05.tar.lz4"
+	;;
+*)
+	for last; do :; done
+	printf backup > "$last"
+	;;
+esac
+`
+
+func TestListAndDownload(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "rsync"), []byte(fakeRsync), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(t.TempDir(), "rsync.log")
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("RSYNC_LOG", logPath)
+	storageObj := New(&Config{Host: "backup", RemotePath: "/backup/", Port: 22, Username: "root", KnownHostsPath: "/root/.ssh/known_hosts"})
+	backupList, err := storageObj.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backupList) != 1 || backupList[0].Name != "db_2024-01-02T03-04-05.tar.lz4" || backupList[0].Size != 6 {
+		t.Fatalf("unexpected backup list %+v", backupList)
+	}
+	destination := filepath.Join(t.TempDir(), backupList[0].Name)
+	if err := storageObj.Download(destination, backupList[0].Name); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(destination); err != nil || string(content) != "backup" {
+		t.Fatalf("backup is not downloaded: %v", err)
+	}
+	calls, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two rsync calls, got %q", lines)
+	}
+	if download := lines[1]; strings.Contains(download, "--list-only") || !strings.Contains(download, "--archive") {
+		t.Fatalf("unexpected arguments of the download %q", download)
+	}
+}
+
+func TestRsh(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *Config
+		expected string
+	}{
+		{
+			name:     "known hosts",
+			config:   &Config{Port: 2222, Username: "backup", SSHKeyPath: "/ssh/id", KnownHostsPath: "/ssh/known_hosts"},
+			expected: "/usr/bin/ssh -i /ssh/id -p 2222 -o StrictHostKeyChecking=yes -o UserKnownHostsFile=/ssh/known_hosts -l backup",
+		},
+		{
+			name:     "ignored host key",
+			config:   &Config{Port: 22, Username: "root", InsecureIgnoreHostKey: true},
+			expected: "/usr/bin/ssh -p 22 -o StrictHostKeyChecking=no -l root",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rsh := rsh(test.config); rsh != test.expected {
+				t.Fatalf("unexpected ssh transport %q", rsh)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package s3
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
+	"clickhouse-tools/pkg/progress"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StateExtension = ".s3upload"
+)
+
+// multipartState is persisted next to the uploaded file after every completed
+// part, so an interrupted upload can be continued with `upload --resume`.
+type multipartState struct {
+	Bucket   string           `json:"bucket"`
+	Key      string           `json:"key"`
+	UploadId string           `json:"upload_id"`
+	Size     int64            `json:"size"`
+	ModTime  time.Time        `json:"mod_time"`
+	PartSize int64            `json:"part_size"`
+	Parts    map[int64]string `json:"parts"`
+}
+
+func (s *Storage) SetResume(resume bool) {
+	s.resume = resume
+}
+
+// SetProfile names the storage profile, so uploads of the same file to
+// several profiles keep separate states.
+func (s *Storage) SetProfile(profile string) {
+	s.profile = profile
+}
+
+func (s *Storage) ListMultipartUploads() ([]types.MultipartUpload, error) {
+	var uploads []types.MultipartUpload
+	sess, err := s.connect(s.config.Write)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3.New(sess).ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.prefix()),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			uploads = append(uploads, types.MultipartUpload{
+				Key:       aws.StringValue(upload.Key),
+				UploadId:  aws.StringValue(upload.UploadId),
+				Initiated: aws.TimeValue(upload.Initiated),
+			})
+		}
+		return true
+	}); err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *Storage) AbortMultipartUpload(upload types.MultipartUpload) error {
+	sess, err := s.connect(s.config.Write)
+	if err != nil {
+		return err
+	}
+	if _, err := s3.New(sess).AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadId),
+	}); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) uploadMultipart(s3Client *s3.S3, src string, file *os.File, fileStat os.FileInfo, checksum string, uploadProgress *progress.Progress) error {
+	key := s.objectKey(fileStat.Name())
+	statePath := s.statePath(src, key)
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+	if state != nil && !(s.resume && state.matches(s.config.Bucket, key, fileStat, s.partSizeFor(fileStat.Size()))) {
+		s.abortState(s3Client, state)
+		state = nil
+	}
+	if state == nil {
+		if state, err = s.createMultipartUpload(s3Client, key, fileStat, checksum); err != nil {
+			return err
+		}
+		if err := state.save(statePath); err != nil {
+			return err
+		}
+	} else {
+		helper.ColoredPrint(helper.ColorYellow, fmt.Sprintf("resume after %d uploaded parts...", len(state.Parts)))
+		uploadProgress.Add(state.uploadedSize())
+	}
+	if err := s.uploadParts(s3Client, file, state, statePath); err != nil {
+		return err
+	}
+	completedParts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for partNumber, eTag := range state.Parts {
+		completedParts = append(completedParts, &s3.CompletedPart{
+			PartNumber: aws.Int64(partNumber),
+			ETag:       aws.String(eTag),
+		})
+	}
+	sort.Slice(completedParts, func(i, j int) bool {
+		return *completedParts[i].PartNumber < *completedParts[j].PartNumber
+	})
+	if _, err := s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(state.Bucket),
+		Key:             aws.String(state.Key),
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	}); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err := os.Remove(statePath); err != nil {
+		log.Errorf("%+v", err)
+	}
+	return nil
+}
+
+func (s *Storage) createMultipartUpload(s3Client *s3.S3, key string, fileStat os.FileInfo, checksum string) (*multipartState, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	if checksum != "" {
+		input.Metadata = map[string]*string{types.ChecksumKey: aws.String(checksum)}
+	}
+	if s.config.ACL != "" {
+		input.ACL = aws.String(s.config.ACL)
+	}
+	if s.config.StorageClass != "" {
+		input.StorageClass = aws.String(s.config.StorageClass)
+	}
+	if s.config.SSE != "" {
+		input.ServerSideEncryption = aws.String(s.config.SSE)
+	}
+	if s.config.SSEKMSKeyId != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.config.SSEKMSKeyId)
+	}
+	if s.config.SSECustomerKey != "" {
+		input.ServerSideEncryption = nil
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	if s.config.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(s.config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(s.retainUntilDate())
+	}
+	output, err := s3Client.CreateMultipartUpload(input)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return &multipartState{
+		Bucket:   s.config.Bucket,
+		Key:      key,
+		UploadId: aws.StringValue(output.UploadId),
+		Size:     fileStat.Size(),
+		ModTime:  fileStat.ModTime(),
+		PartSize: s.partSizeFor(fileStat.Size()),
+		Parts:    map[int64]string{},
+	}, nil
+}
+
+func (s *Storage) uploadParts(s3Client *s3.S3, file *os.File, state *multipartState, statePath string) error {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		uploadErr error
+	)
+	var pendingParts []int64
+	for partNumber := int64(1); partNumber <= (state.Size+state.PartSize-1)/state.PartSize; partNumber++ {
+		if _, ok := state.Parts[partNumber]; !ok {
+			pendingParts = append(pendingParts, partNumber)
+		}
+	}
+	parts := make(chan int64)
+	for worker := 0; worker < s.concurrency(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range parts {
+				offset := (partNumber - 1) * state.PartSize
+				length := state.partLength(partNumber)
+				body := io.NewSectionReader(file, offset, length)
+				input := &s3.UploadPartInput{
+					Bucket:        aws.String(state.Bucket),
+					Key:           aws.String(state.Key),
+					UploadId:      aws.String(state.UploadId),
+					PartNumber:    aws.Int64(partNumber),
+					ContentLength: aws.Int64(length),
+					Body:          body,
+				}
+				if s.config.SSECustomerKey != "" {
+					input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+					input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+				}
+				var (
+					output *s3.UploadPartOutput
+					err    error
+				)
+				// Buckets with Object Lock accept parts only with Content-MD5.
+				if s.config.ObjectLockMode != "" {
+					var partMD5 string
+					if partMD5, err = contentMD5(body); err == nil {
+						input.ContentMD5 = aws.String(partMD5)
+						_, err = body.Seek(0, io.SeekStart)
+					}
+				}
+				if err == nil {
+					output, err = s3Client.UploadPart(input)
+				}
+				mu.Lock()
+				if err != nil {
+					log.Errorf("can't upload part %d: %v", partNumber, err)
+					if uploadErr == nil {
+						uploadErr = err
+					}
+				} else {
+					state.Parts[partNumber] = aws.StringValue(output.ETag)
+					if err := state.save(statePath); err != nil && uploadErr == nil {
+						uploadErr = err
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, partNumber := range pendingParts {
+		parts <- partNumber
+	}
+	close(parts)
+	wg.Wait()
+	return uploadErr
+}
+
+// statePath returns the state file of the upload of src to the key, named
+// "<src>.<profile>.<hash of bucket and key>.s3upload".
+func (s *Storage) statePath(src, key string) string {
+	hash := sha1.Sum([]byte(s.config.Bucket + "/" + key))
+	return fmt.Sprintf("%s.%s.%x%s", src, s.profile, hash[:4], StateExtension)
+}
+
+func (s *Storage) abortState(s3Client *s3.S3, state *multipartState) {
+	if _, err := s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadId),
+	}); err != nil {
+		log.Warnf("can't abort previous multipart upload '%s': %v", state.UploadId, err)
+	}
+}
+
+func (s *Storage) partSize() int64 {
+	if s.config.PartSize < s3manager.MinUploadPartSize {
+		return s3manager.MinUploadPartSize
+	}
+	return s.config.PartSize
+}
+
+// partSizeFor raises the part size for large files, so that they fit into
+// the maximum number of parts of a multipart upload.
+func (s *Storage) partSizeFor(size int64) int64 {
+	partSize := s.partSize()
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+func (s *Storage) concurrency() int {
+	if s.config.Concurrency < 1 {
+		return s3manager.DefaultUploadConcurrency
+	}
+	return s.config.Concurrency
+}
+
+func loadState(statePath string) (*multipartState, error) {
+	content, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	var state multipartState
+	if err := json.Unmarshal(content, &state); err != nil {
+		log.Warnf("ignore broken multipart upload state '%s': %v", statePath, err)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (state *multipartState) matches(bucket, key string, fileStat os.FileInfo, partSize int64) bool {
+	return state.Bucket == bucket &&
+		state.Key == key &&
+		state.Size == fileStat.Size() &&
+		state.ModTime.Equal(fileStat.ModTime()) &&
+		state.PartSize == partSize
+}
+
+// partLength returns the length of the part, the last one may be shorter.
+func (state *multipartState) partLength(partNumber int64) int64 {
+	offset := (partNumber - 1) * state.PartSize
+	if offset+state.PartSize > state.Size {
+		return state.Size - offset
+	}
+	return state.PartSize
+}
+
+func (state *multipartState) uploadedSize() int64 {
+	var size int64
+	for partNumber := range state.Parts {
+		size += state.partLength(partNumber)
+	}
+	return size
+}
+
+func (state *multipartState) save(statePath string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0640); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
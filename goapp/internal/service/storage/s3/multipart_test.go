@@ -0,0 +1,41 @@
+package s3
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"testing"
+)
+
+func TestPartSizeFor(t *testing.T) {
+	storage := New(&Config{PartSize: 100 * 1024 * 1024})
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{name: "small file", size: 1024},
+		{name: "last size with the configured part size", size: 100 * 1024 * 1024 * (s3manager.MaxUploadParts - 1)},
+		{name: "1 TiB", size: 1 << 40},
+		{name: "5 TiB", size: 5 << 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &multipartState{Size: test.size, PartSize: storage.partSizeFor(test.size)}
+			if state.PartSize < storage.partSize() {
+				t.Fatalf("part size %d is less than the configured one", state.PartSize)
+			}
+			if parts := (state.Size + state.PartSize - 1) / state.PartSize; parts > s3manager.MaxUploadParts {
+				t.Fatalf("%d parts exceed the limit", parts)
+			}
+		})
+	}
+}
+
+func TestUploadedSize(t *testing.T) {
+	state := &multipartState{Size: 25, PartSize: 10, Parts: map[int64]string{1: "a", 3: "c"}}
+	if size := state.uploadedSize(); size != 15 {
+		t.Fatalf("expected 15 uploaded bytes with the short last part, got %d", size)
+	}
+	state.Parts[2] = "b"
+	if size := state.uploadedSize(); size != state.Size {
+		t.Fatalf("expected all %d bytes uploaded, got %d", state.Size, size)
+	}
+}
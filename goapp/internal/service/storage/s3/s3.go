@@ -1,45 +1,82 @@
 package s3
 
 import (
-	"bytes"
 	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/storage/types"
 	"clickhouse-tools/pkg/encryptor"
+	"clickhouse-tools/pkg/progress"
+	"clickhouse-tools/pkg/throttle"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
-	Name = "s3"
+	Name            = "s3"
+	roleSessionName = "clickhouse-tools"
+	// deleteBatchSize is the limit of keys of a DeleteObjects request.
+	deleteBatchSize = 1000
 )
 
+// Keys holds static credentials and an optional role to assume. Empty keys
+// fall back to the default AWS credential chain.
 type Keys struct {
-	AccessKey, SecretKey string
+	AccessKey, SecretKey, RoleArn string
 }
 
 type Config struct {
 	Write                                               *Keys
 	Read                                                *Keys
 	Bucket, Directory, Endpoint, Region, ACL, SSE       string
+	SSEKMSKeyId, SSECustomerKey, StorageClass, CABundle string
+	Profile, RoleExternalId, StsEndpoint                string
+	ObjectLockMode                                      string
+	ObjectLockRetentionDays                             int
 	ForcePathStyle, DisableSSL, DisableCertVerification bool
-	PartSize                                            int64
+	PartSize, UploadLimit, DownloadLimit                int64
+	Concurrency                                         int
 }
 
 type Storage struct {
-	config    *Config
-	encryptor *encryptor.Encryptor
+	config                     *Config
+	profile                    string
+	resume                     bool
+	checksum                   string
+	uploadLimit, downloadLimit *throttle.Limiter
 }
 
-func New(conf *Config, encryptor *encryptor.Encryptor) *Storage {
+func New(conf *Config) *Storage {
 	return &Storage{
-		config:    conf,
-		encryptor: encryptor,
+		config:        conf,
+		profile:       Name,
+		uploadLimit:   throttle.New(conf.UploadLimit),
+		downloadLimit: throttle.New(conf.DownloadLimit),
+	}
+}
+
+// SetRateLimit overrides the configured limits, zero keeps a limit as is.
+func (s *Storage) SetRateLimit(upload, download int64) {
+	if upload > 0 {
+		s.uploadLimit = throttle.New(upload)
+	}
+	if download > 0 {
+		s.downloadLimit = throttle.New(download)
 	}
 }
 
@@ -49,14 +86,12 @@ func (s *Storage) Upload(src string) error {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
-	encSrc, err := s.encryptor.EncryptFile(src)
-	if err != nil {
-		log.Errorf("%+v", err)
+	fmt.Print("Upload backup by s3...")
+	if err := s.validateObjectLock(); err != nil {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
-	fmt.Print("Upload backup by s3...")
-	file, err := os.Open(encSrc)
+	file, err := os.Open(src)
 	if err != nil {
 		log.Errorf("%+v", err)
 		helper.ColoredPrintln(helper.ColorRed, "error!")
@@ -74,19 +109,76 @@ func (s *Storage) Upload(src string) error {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
-	uploader := s3manager.NewUploader(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(strings.Join([]string{s.config.Bucket, s.config.Directory}, "/") + "/"),
-		ACL:    aws.String(s.config.ACL),
-		Key:    aws.String(fileStat.Name()),
-		Body:   file,
-	})
+	checksum, err := types.UploadChecksum(src, s.checksum)
+	s.checksum = ""
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	uploadProgress := progress.Start("upload", fileStat.Size())
+	sess.Config.HTTPClient.Transport = uploadProgress.Transport(sess.Config.HTTPClient.Transport)
+	err = s.upload(sess, src, file, fileStat, checksum, uploadProgress)
+	uploadProgress.Finish()
 	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) upload(sess *session.Session, src string, file *os.File, fileStat os.FileInfo, checksum string, uploadProgress *progress.Progress) error {
+	if fileStat.Size() > s.partSize() {
+		return s.uploadMultipart(s3.New(sess), src, file, fileStat, checksum, uploadProgress)
+	}
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s.config.PartSize
+		u.Concurrency = s.config.Concurrency
+	})
+	input := s.uploadInput(fileStat.Name(), file)
+	if checksum != "" {
+		input.Metadata = map[string]*string{types.ChecksumKey: aws.String(checksum)}
+	}
+	if s.config.ObjectLockMode != "" {
+		contentMD5, err := contentMD5(io.NewSectionReader(file, 0, fileStat.Size()))
+		if err != nil {
+			return err
+		}
+		input.ContentMD5 = aws.String(contentMD5)
+	}
+	if _, err := uploader.Upload(input); err != nil {
 		log.Errorf("%+v", err)
+		return err
+	}
+	return nil
+}
+
+// UploadStream uploads a backup read from a stream, buffering only the parts
+// in flight.
+func (s *Storage) UploadStream(backupName string, reader io.Reader, size int64) error {
+	sess, err := s.connect(s.config.Write)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	fmt.Print("Upload backup by s3...")
+	if err := s.validateObjectLock(); err != nil {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
-	if err = os.Remove(encSrc); err != nil {
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s.partSizeFor(size)
+		u.Concurrency = s.config.Concurrency
+	})
+	uploadProgress := progress.Start("upload", size)
+	input := s.uploadInput(backupName, uploadProgress.Reader(reader))
+	if s.checksum != "" {
+		input.Metadata = map[string]*string{types.ChecksumKey: aws.String(s.checksum)}
+	}
+	s.checksum = ""
+	_, err = uploader.Upload(input)
+	uploadProgress.Finish()
+	if err != nil {
 		log.Errorf("%+v", err)
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
@@ -95,35 +187,133 @@ func (s *Storage) Upload(src string) error {
 	return nil
 }
 
-func (s *Storage) GetBackupListString() (string, error) {
-	var listBuffer bytes.Buffer
+func (s *Storage) uploadInput(backupName string, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.objectKey(backupName)),
+		Body:   body,
+	}
+	if s.config.ACL != "" {
+		input.ACL = aws.String(s.config.ACL)
+	}
+	if s.config.StorageClass != "" {
+		input.StorageClass = aws.String(s.config.StorageClass)
+	}
+	if s.config.SSE != "" {
+		input.ServerSideEncryption = aws.String(s.config.SSE)
+	}
+	if s.config.SSEKMSKeyId != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.config.SSEKMSKeyId)
+	}
+	if s.config.SSECustomerKey != "" {
+		input.ServerSideEncryption = nil
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	if s.config.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(s.config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(s.retainUntilDate())
+	}
+	return input
+}
+
+// List pages through the objects directly under the configured directory.
+// Backups stored as a sub-directory of objects are reported as one entry
+// with the number of objects as volumes.
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
 	sess, err := s.connect(s.config.Read)
 	if err != nil {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
-		return "", err
+		return nil, err
 	}
-
 	s3Client := s3.New(sess)
+	prefix := s.prefix()
+	var subDirectories []string
+	if err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.config.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(item.Key), prefix)
+			if name == "" {
+				continue
+			}
+			backup := types.NewBackupInfo(name, aws.Int64Value(item.Size), aws.TimeValue(item.LastModified))
+			backup.MD5 = s.etagMD5(aws.StringValue(item.ETag))
+			backupList = append(backupList, backup)
+		}
+		for _, commonPrefix := range page.CommonPrefixes {
+			subDirectories = append(subDirectories, aws.StringValue(commonPrefix.Prefix))
+		}
+		return true
+	}); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return nil, err
+	}
+	for _, subDirectory := range subDirectories {
+		backup, err := s.listSubDirectory(s3Client, subDirectory)
+		if err != nil {
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return nil, err
+		}
+		if backup.Volumes > 0 {
+			backupList = append(backupList, *backup)
+		}
+	}
+	return types.GroupVolumes(backupList), nil
+}
 
-	list, err := s3Client.ListObjects(&s3.ListObjectsInput{
+func (s *Storage) listSubDirectory(s3Client *s3.S3, subDirectory string) (*types.BackupInfo, error) {
+	backup := types.NewBackupInfo(strings.TrimSuffix(strings.TrimPrefix(subDirectory, s.prefix()), "/"), 0, time.Time{})
+	backup.Volumes = 0
+	if err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: aws.String(s.config.Bucket),
-		Prefix: aws.String(s.config.Directory),
-	})
-
-	if err != nil {
+		Prefix: aws.String(subDirectory),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			backup.Volumes++
+			backup.Size += aws.Int64Value(item.Size)
+			if aws.TimeValue(item.LastModified).After(backup.ModTime) {
+				backup.ModTime = aws.TimeValue(item.LastModified)
+			}
+			if strings.HasSuffix(aws.StringValue(item.Key), encryptor.Extension) {
+				backup.Encrypted = true
+			}
+		}
+		return true
+	}); err != nil {
 		log.Errorf("%+v", err)
-		helper.ColoredPrintln(helper.ColorRed, "error!")
-		return "", err
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// etagMD5 returns the ETag when it is the MD5 of the object, which is not the
+// case for multipart uploads and objects encrypted with KMS or customer keys.
+func (s *Storage) etagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") || s.config.SSEKMSKeyId != "" || s.config.SSECustomerKey != "" || s.config.SSE == s3.ServerSideEncryptionAwsKms {
+		return ""
 	}
+	return etag
+}
 
-	for _, item := range list.Contents {
-		date := item.LastModified.Format("2006/01/02 15:04:05")
-		name := strings.ReplaceAll(*item.Key, strings.Join([]string{s.config.Directory, "/"}, ""), "")
-		listBuffer.WriteString(date + " " + name + "\n\r")
+// prefix returns the configured directory with a trailing slash, so listing
+// "backups" does not pick up objects from "backups-old".
+func (s *Storage) prefix() string {
+	directory := strings.Trim(s.config.Directory, "/")
+	if directory == "" {
+		return ""
 	}
-	return listBuffer.String(), nil
+	return directory + "/"
 }
 
+// Download fetches the backup with the concurrent downloader. With resume
+// enabled a shorter local file is continued with a ranged GET instead.
 func (s *Storage) Download(destination, backupName string) error {
 	sess, err := s.connect(s.config.Read)
 	if err != nil {
@@ -131,63 +321,404 @@ func (s *Storage) Download(destination, backupName string) error {
 		return err
 	}
 
-	file, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	fmt.Print("Download backup from s3...")
+	s3Client := s3.New(sess)
+	head, err := s.headObject(s3Client, backupName)
 	if err != nil {
-		log.Errorf("%+v", err)
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	size := aws.Int64Value(head.ContentLength)
+	var offset int64
+	if s.resume {
+		offset = resumeOffset(destination, size)
+		if offset == size {
+			helper.ColoredPrintln(helper.ColorGreen, "done!")
+			return nil
+		}
+	}
+	downloadProgress := progress.Start("download", size)
+	downloadProgress.Add(offset)
+	if offset > 0 {
+		err = s.resumeDownload(s3Client, destination, backupName, head, offset, downloadProgress)
+	} else {
+		err = s.download(s3Client, destination, backupName, downloadProgress)
+	}
+	downloadProgress.Finish()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
 
-	fmt.Print("Download backup from s3...")
-	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
-		d.PartSize = 128 * 1024 * 1024 // 128MB per part
-		d.Concurrency = 10
+func (s *Storage) download(s3Client *s3.S3, destination, backupName string, downloadProgress *progress.Progress) error {
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	downloader := s3manager.NewDownloaderWithClient(s3Client, func(d *s3manager.Downloader) {
+		d.PartSize = s.config.PartSize
+		d.Concurrency = s.config.Concurrency
 	})
-	if _, err := downloader.Download(file, &s3.GetObjectInput{
-		Bucket: aws.String(strings.Join([]string{s.config.Bucket, s.config.Directory}, "/") + "/"),
-		Key:    aws.String(backupName),
-	}); err != nil {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.objectKey(backupName)),
+	}
+	if s.config.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	if _, err := downloader.Download(downloadProgress.WriterAt(file), input); err != nil {
+		log.Errorf("%+v", err)
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
 		log.Errorf("%+v", err)
-		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	return nil
+}
+
+func (s *Storage) headObject(s3Client *s3.S3, backupName string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.objectKey(backupName)),
+	}
+	if s.config.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	head, err := s3Client.HeadObject(input)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return head, nil
+}
+
+func (s *Storage) SetChecksum(checksum string) {
+	s.checksum = checksum
+}
+
+// Checksum returns the checksum recorded in the object metadata, empty for
+// backups uploaded without it.
+func (s *Storage) Checksum(backupName string) (string, error) {
+	sess, err := s.connect(s.config.Read)
+	if err != nil {
+		return "", err
+	}
+	head, err := s.headObject(s3.New(sess), backupName)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range head.Metadata {
+		if strings.EqualFold(key, types.ChecksumKey) {
+			return aws.StringValue(value), nil
+		}
+	}
+	return "", nil
+}
+
+// resumeOffset returns the size of a partially downloaded file to continue
+// from, or zero when there is nothing to resume from.
+func resumeOffset(destination string, size int64) int64 {
+	fileStat, err := os.Stat(destination)
+	if err != nil || fileStat.Size() == 0 || fileStat.Size() > size {
+		return 0
+	}
+	if fileStat.Size() == size {
+		helper.ColoredPrint(helper.ColorYellow, "already downloaded...")
+	} else {
+		helper.ColoredPrint(helper.ColorYellow, fmt.Sprintf("resume from %s...", helper.FormatBytes(fileStat.Size())))
+	}
+	return fileStat.Size()
+}
 
+// resumeDownload appends the missing tail of the object to a partially
+// downloaded file.
+func (s *Storage) resumeDownload(s3Client *s3.S3, destination, backupName string, head *s3.HeadObjectOutput, offset int64, downloadProgress *progress.Progress) error {
+	input := &s3.GetObjectInput{
+		Bucket:  aws.String(s.config.Bucket),
+		Key:     aws.String(s.objectKey(backupName)),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		IfMatch: head.ETag,
+	}
+	if s.config.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	output, err := s3Client.GetObject(input)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		err := body.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(output.Body)
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	if _, err := io.Copy(downloadProgress.Writer(file), output.Body); err != nil {
+		log.Errorf("%+v", err)
+		_ = file.Close()
+		return err
+	}
 	if err := file.Close(); err != nil {
 		log.Errorf("%+v", err)
-		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	return nil
+}
 
-	if _, err := s.encryptor.DecryptFile(destination); err != nil {
+func (s *Storage) DownloadStream(backupName string) (io.ReadCloser, error) {
+	sess, err := s.connect(s.config.Read)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.objectKey(backupName)),
+	}
+	if s.config.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.config.SSECustomerKey)
+	}
+	output, err := s3.New(sess).GetObject(input)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// Delete removes every object of the backup, its volumes and the objects of
+// its sub-directory included, in batches. Nothing is removed when one of them
+// is locked.
+func (s *Storage) Delete(backupName string) error {
+	sess, err := s.connect(s.config.Write)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	fmt.Print("Delete backup from s3...")
+	s3Client := s3.New(sess)
+	keys, err := s.backupKeys(s3Client, backupName)
+	if err != nil {
 		helper.ColoredPrintln(helper.ColorRed, "error!")
 		return err
 	}
+	if len(keys) == 0 {
+		err := fmt.Errorf("backup '%s' not found", backupName)
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	for _, key := range keys {
+		if err := s.checkObjectLock(s3Client, strings.TrimPrefix(key, s.prefix())); err != nil {
+			helper.ColoredPrintln(helper.ColorYellow, "locked!")
+			return err
+		}
+	}
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:min(start+deleteBatchSize, len(keys))] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		result, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.config.Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err == nil && len(result.Errors) > 0 {
+			err = fmt.Errorf("can't delete '%s': %s", aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+		}
+		if err != nil {
+			log.Errorf("%+v", err)
+			helper.ColoredPrintln(helper.ColorRed, "error!")
+			return err
+		}
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// backupKeys lists the keys of every object of the logical backup, see
+// types.BelongsTo.
+func (s *Storage) backupKeys(s3Client *s3.S3, backupName string) ([]string, error) {
+	var keys []string
+	prefix := s.prefix()
+	if err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.objectKey(backupName)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if key := aws.StringValue(item.Key); types.BelongsTo(strings.TrimPrefix(key, prefix), backupName) {
+				keys = append(keys, key)
+			}
+		}
+		return true
+	}); err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	return keys, nil
+}
 
-	if err := os.Remove(destination); err != nil {
+func (s *Storage) checkObjectLock(s3Client *s3.S3, backupName string) error {
+	key := s.objectKey(backupName)
+	retention, err := s3Client.GetObjectRetention(&s3.GetObjectRetentionInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && retention.Retention != nil && aws.TimeValue(retention.Retention.RetainUntilDate).After(time.Now()) {
+		err := fmt.Errorf(
+			"%w: '%s' is retained in %s mode until %s",
+			types.ErrObjectLocked,
+			backupName,
+			aws.StringValue(retention.Retention.Mode),
+			aws.TimeValue(retention.Retention.RetainUntilDate).Format(time.DateTime),
+		)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err != nil && !isObjectLockNotConfigured(err) {
+		log.Warnf("can't get object lock retention of '%s': %v", key, err)
+	}
+	legalHold, err := s3Client.GetObjectLegalHold(&s3.GetObjectLegalHoldInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && legalHold.LegalHold != nil && aws.StringValue(legalHold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn {
+		err := fmt.Errorf("%w: '%s' is under legal hold", types.ErrObjectLocked, backupName)
 		log.Errorf("%+v", err)
 		return err
 	}
+	if err != nil && !isObjectLockNotConfigured(err) {
+		log.Warnf("can't get object lock legal hold of '%s': %v", key, err)
+	}
+	return nil
+}
 
-	helper.ColoredPrintln(helper.ColorGreen, "done!")
+func (s *Storage) validateObjectLock() error {
+	if s.config.ObjectLockMode == "" {
+		return nil
+	}
+	if s.config.ObjectLockMode != s3.ObjectLockModeGovernance && s.config.ObjectLockMode != s3.ObjectLockModeCompliance {
+		err := fmt.Errorf("unsupported object lock mode '%s'", s.config.ObjectLockMode)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if s.config.ObjectLockRetentionDays < 1 {
+		err := errors.New("object lock retention days must be positive")
+		log.Errorf("%+v", err)
+		return err
+	}
 	return nil
 }
 
+func (s *Storage) retainUntilDate() time.Time {
+	return time.Now().AddDate(0, 0, s.config.ObjectLockRetentionDays)
+}
+
+func isObjectLockNotConfigured(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case "ObjectLockConfigurationNotFoundError", "NoSuchObjectLockConfiguration", "InvalidRequest":
+		return true
+	}
+	return false
+}
+
+func contentMD5(reader io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *Storage) objectKey(backupName string) string {
+	return s.prefix() + backupName
+}
+
+// connect creates a session with the static keys when they are set, otherwise
+// with the default credential chain: environment, shared credentials and
+// config files (S3_PROFILE), web identity token and instance or task role.
+// The resulting credentials are used to assume RoleArn when it is defined.
 func (s *Storage) connect(keys *Keys) (*session.Session, error) {
-	sess, err := session.NewSession(
-		&aws.Config{
-			Credentials: credentials.NewStaticCredentials(
-				keys.AccessKey,
-				keys.SecretKey,
-				"",
-			),
+	options := session.Options{
+		Profile:           s.config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		Config: aws.Config{
 			Endpoint:         aws.String(s.config.Endpoint),
 			Region:           aws.String(s.config.Region),
-			DisableSSL:       aws.Bool(true),
-			S3ForcePathStyle: aws.Bool(true),
-		})
+			DisableSSL:       aws.Bool(s.config.DisableSSL),
+			S3ForcePathStyle: aws.Bool(s.config.ForcePathStyle),
+			HTTPClient: &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: s.config.DisableCertVerification,
+					},
+				},
+			},
+		},
+	}
+	if s.config.CABundle != "" {
+		caBundle, err := os.Open(s.config.CABundle)
+		if err != nil {
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		defer func(caBundle *os.File) {
+			err := caBundle.Close()
+			if err != nil {
+				log.Errorf("%+v", err)
+			}
+		}(caBundle)
+		options.CustomCABundle = caBundle
+	}
+	if keys.AccessKey != "" {
+		options.Config.Credentials = credentials.NewStaticCredentials(keys.AccessKey, keys.SecretKey, "")
+	}
+	sess, err := session.NewSessionWithOptions(options)
 	if err != nil {
 		log.Errorf("%+v", err)
 		return nil, err
 	}
-	return sess, nil
+	// Wrapped only now, as the SDK loads the CA bundle into *http.Transport.
+	if s.uploadLimit != nil || s.downloadLimit != nil {
+		sess.Config.HTTPClient.Transport = &throttle.Transport{
+			Base:     sess.Config.HTTPClient.Transport,
+			Upload:   s.uploadLimit,
+			Download: s.downloadLimit,
+		}
+	}
+	if keys.RoleArn == "" {
+		return sess, nil
+	}
+	// STS must not inherit the S3 endpoint and its plain HTTP setting.
+	stsClient := sts.New(sess, &aws.Config{
+		Endpoint:   aws.String(s.config.StsEndpoint),
+		DisableSSL: aws.Bool(false),
+	})
+	roleCredentials := stscreds.NewCredentialsWithClient(stsClient, keys.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = roleSessionName
+		if s.config.RoleExternalId != "" {
+			provider.ExternalID = aws.String(s.config.RoleExternalId)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: roleCredentials}), nil
 }
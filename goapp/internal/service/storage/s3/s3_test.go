@@ -0,0 +1,112 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBucket is a path-style S3 API of a single bucket with listing and batch
+// deletes, object lock is reported as not configured.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]bool
+	deletes int
+}
+
+func (fake *fakeBucket) handle(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case query.Has("retention") || query.Has("legal-hold"):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, "<Error><Code>ObjectLockConfigurationNotFoundError</Code><Message>no object lock</Message></Error>")
+	case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+		var keys []string
+		for key := range fake.objects {
+			if strings.HasPrefix(key, query.Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		_, _ = fmt.Fprint(w, "<ListBucketResult>")
+		for _, key := range keys {
+			_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>1</Size></Contents>", key)
+		}
+		_, _ = fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+	case r.Method == http.MethodPost && query.Has("delete"):
+		var request struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.deletes++
+		for _, object := range request.Objects {
+			delete(fake.objects, object.Key)
+		}
+		_, _ = fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	objects := []string{
+		"Backup/db_2024-01-02T03-04-05.tar.lz4",
+		"Backup/db_2024-01-02T03-04-05.tar.lz4.001",
+		"Backup/db_2024-01-02T03-04-05.tar.lz4.002",
+		"Backup/db_2024-01-02T03-04-05.tar.lz4/data.001",
+		"Backup/db_2024-01-02T03-04-05.tar.lz4.enc",
+		"Backup/db_2024-01-02T03-04-05.tar.lz4.s3upload",
+		"Backup-old/db_2024-01-02T03-04-05.tar.lz4",
+	}
+	tests := []struct {
+		name       string
+		backupName string
+		left       []string
+		success    bool
+	}{
+		{name: "volumes and sub-directory", backupName: "db_2024-01-02T03-04-05.tar.lz4", left: objects[4:], success: true},
+		{name: "encrypted", backupName: "db_2024-01-02T03-04-05.tar.lz4.enc", left: append(append([]string{}, objects[:4]...), objects[5:]...), success: true},
+		{name: "missing", backupName: "db_2024-01-03T03-04-05.tar.lz4", left: objects},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeBucket{objects: map[string]bool{}}
+			for _, object := range objects {
+				fake.objects[object] = true
+			}
+			server := httptest.NewServer(http.HandlerFunc(fake.handle))
+			t.Cleanup(server.Close)
+			keys := &Keys{AccessKey: "access", SecretKey: "secret"}
+			storage := New(&Config{Write: keys, Read: keys, Bucket: "bucket", Directory: "Backup", Endpoint: server.URL, Region: "us-east-1", ForcePathStyle: true})
+			if err := storage.Delete(test.backupName); (err == nil) != test.success {
+				t.Fatalf("unexpected result of the delete: %v", err)
+			}
+			var left []string
+			for object := range fake.objects {
+				left = append(left, object)
+			}
+			sort.Strings(left)
+			expected := append([]string{}, test.left...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(left, expected) {
+				t.Fatalf("unexpected objects left %q", left)
+			}
+			if test.success && fake.deletes != 1 {
+				t.Fatalf("expected a single batch delete, got %d", fake.deletes)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package sftp
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/internal/service/sshclient"
+	"clickhouse-tools/internal/service/storage/types"
+	"clickhouse-tools/pkg/progress"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	Name                 = "sftp"
+	partExtension        = ".part"
+	sourceExtension      = ".part.source"
+	posixRenameExtension = "posix-rename@openssh.com"
+)
+
+type Config struct {
+	Host, Username, Password, RemotePath, KeyPath, KnownHostsPath string
+	Port                                                          int
+	InsecureIgnoreHostKey                                         bool
+}
+
+type Storage struct {
+	config *Config
+	resume bool
+}
+
+type streamReader struct {
+	*io.PipeReader
+	conn *connection
+}
+
+type connection struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func New(conf *Config) *Storage {
+	return &Storage{
+		config: conf,
+	}
+}
+
+// SetResume continues the uploads interrupted earlier instead of starting over.
+func (s *Storage) SetResume(resume bool) {
+	s.resume = resume
+}
+
+// Upload writes the backup into a ".part" file and renames it when the upload
+// is complete. The size and the SHA-256 of the local file are kept next to it
+// in a ".part.source" file, on resume a ".part" file left by an interrupted
+// upload of the same file is continued from its current size. The data is
+// written sequentially, so the size of the ".part" file never covers a hole
+// left by a lost write.
+func (s *Storage) Upload(src string) error {
+	conn, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer conn.close()
+	fmt.Print("Upload backup by sftp...")
+	file, err := os.Open(src)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	fileStat, err := file.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if err := conn.sftp.MkdirAll(s.config.RemotePath); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	checksum, err := helper.FileSHA256(src)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	source := fmt.Sprintf("%d %s", fileStat.Size(), checksum)
+	dstPath := path.Join(s.config.RemotePath, fileStat.Name())
+	partPath, sourcePath := dstPath+partExtension, dstPath+sourceExtension
+	offset, err := conn.resumeOffset(partPath, sourcePath, source, fileStat.Size(), s.resume)
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset > 0 {
+		helper.ColoredPrint(helper.ColorYellow, fmt.Sprintf("resume from %s...", helper.FormatBytes(offset)))
+	} else {
+		flags |= os.O_TRUNC
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	remoteFile, err := conn.sftp.OpenFile(partPath, flags)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = remoteFile.Close()
+		return err
+	}
+	uploadProgress := progress.Start("upload", fileStat.Size())
+	uploadProgress.Add(offset)
+	_, err = remoteFile.ReadFrom(uploadProgress.Reader(file))
+	uploadProgress.Finish()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = remoteFile.Close()
+		return err
+	}
+	if err := remoteFile.Close(); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if err := conn.rename(partPath, dstPath); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	conn.remove(sourcePath)
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) UploadStream(backupName string, reader io.Reader, size int64) error {
+	conn, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer conn.close()
+	fmt.Print("Upload backup by sftp...")
+	if err := conn.sftp.MkdirAll(s.config.RemotePath); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	dstPath := path.Join(s.config.RemotePath, backupName)
+	partPath := dstPath + partExtension
+	// The part of a stream is never resumed.
+	conn.remove(dstPath + sourceExtension)
+	remoteFile, err := conn.sftp.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	uploadProgress := progress.Start("upload", size)
+	_, err = remoteFile.ReadFrom(uploadProgress.Reader(reader))
+	uploadProgress.Finish()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = remoteFile.Close()
+		return err
+	}
+	if err := remoteFile.Close(); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	if err := conn.rename(partPath, dstPath); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) List() ([]types.BackupInfo, error) {
+	var backupList []types.BackupInfo
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	files, err := conn.sftp.ReadDir(s.config.RemotePath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), partExtension) || strings.HasSuffix(file.Name(), sourceExtension) {
+			continue
+		}
+		backupList = append(backupList, types.NewBackupInfo(file.Name(), file.Size(), file.ModTime()))
+	}
+	return backupList, nil
+}
+
+func (s *Storage) Download(destination, backupName string) error {
+	conn, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer conn.close()
+	fmt.Print("Download backup by sftp...")
+	remotePath := path.Join(s.config.RemotePath, backupName)
+	remoteStat, err := conn.sftp.Stat(remotePath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	remoteFile, err := conn.sftp.Open(remotePath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer func(remoteFile *sftp.File) {
+		if err := remoteFile.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(remoteFile)
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	downloadProgress := progress.Start("download", remoteStat.Size())
+	_, err = remoteFile.WriteTo(downloadProgress.Writer(file))
+	downloadProgress.Finish()
+	if err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+// DownloadStream returns a reader fed by a concurrent read of the remote file.
+// Closing the reader closes the connection.
+func (s *Storage) DownloadStream(backupName string) (io.ReadCloser, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	remoteFile, err := conn.sftp.Open(path.Join(s.config.RemotePath, backupName))
+	if err != nil {
+		log.Errorf("%+v", err)
+		conn.close()
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := remoteFile.WriteTo(writer)
+		if closeErr := remoteFile.Close(); err == nil {
+			err = closeErr
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	return &streamReader{PipeReader: reader, conn: conn}, nil
+}
+
+func (s *Storage) Delete(backupName string) error {
+	conn, err := s.connect()
+	if err != nil {
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	defer conn.close()
+	fmt.Print("Delete backup by sftp...")
+	if err := conn.sftp.Remove(path.Join(s.config.RemotePath, backupName)); err != nil {
+		log.Errorf("%+v", err)
+		helper.ColoredPrintln(helper.ColorRed, "error!")
+		return err
+	}
+	helper.ColoredPrintln(helper.ColorGreen, "done!")
+	return nil
+}
+
+func (s *Storage) connect() (*connection, error) {
+	sshClient, err := sshclient.Dial(&sshclient.Config{
+		Username:              s.config.Username,
+		Password:              s.config.Password,
+		KeyPath:               s.config.KeyPath,
+		KnownHostsPath:        s.config.KnownHostsPath,
+		Port:                  s.config.Port,
+		InsecureIgnoreHostKey: s.config.InsecureIgnoreHostKey,
+	}, s.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		log.Errorf("can't start sftp subsystem on '%s': %v", s.config.Host, err)
+		_ = sshClient.Close()
+		return nil, err
+	}
+	return &connection{
+		ssh:  sshClient,
+		sftp: sftpClient,
+	}, nil
+}
+
+// resumeOffset is the size of the part to continue on resume when it was
+// written from the same source, otherwise the source of the new part is
+// recorded and the upload starts over.
+func (conn *connection) resumeOffset(partPath, sourcePath, source string, size int64, resume bool) (int64, error) {
+	if resume {
+		partStat, partErr := conn.sftp.Stat(partPath)
+		recorded, sourceErr := conn.readFile(sourcePath)
+		if partErr == nil && sourceErr == nil && recorded == source && partStat.Size() <= size {
+			return partStat.Size(), nil
+		}
+	}
+	sourceFile, err := conn.sftp.OpenFile(sourcePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return 0, err
+	}
+	if _, err := sourceFile.Write([]byte(source)); err != nil {
+		log.Errorf("%+v", err)
+		_ = sourceFile.Close()
+		return 0, err
+	}
+	if err := sourceFile.Close(); err != nil {
+		log.Errorf("%+v", err)
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (conn *connection) readFile(remotePath string) (string, error) {
+	file, err := conn.sftp.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer func(file *sftp.File) {
+		if err := file.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	content, err := io.ReadAll(file)
+	return string(content), err
+}
+
+// remove deletes a file if it exists.
+func (conn *connection) remove(remotePath string) {
+	if err := conn.sftp.Remove(remotePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("%+v", err)
+	}
+}
+
+// rename replaces the target when the server supports the OpenSSH
+// posix-rename extension and falls back to remove and rename otherwise.
+func (conn *connection) rename(oldPath, newPath string) error {
+	if _, ok := conn.sftp.HasExtension(posixRenameExtension); ok {
+		return conn.sftp.PosixRename(oldPath, newPath)
+	}
+	if err := conn.sftp.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return conn.sftp.Rename(oldPath, newPath)
+}
+
+func (conn *connection) close() {
+	if err := conn.sftp.Close(); err != nil && !errors.Is(err, io.EOF) {
+		log.Errorf("%+v", err)
+	}
+	if err := conn.ssh.Close(); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
+
+func (reader *streamReader) Close() error {
+	err := reader.PipeReader.Close()
+	reader.conn.close()
+	return err
+}
@@ -0,0 +1,321 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const (
+	testUsername = "backup"
+	testPassword = "secret"
+)
+
+// startServer runs an in-process ssh server with the sftp subsystem on the
+// local filesystem and returns its address and host key.
+func startServer(t *testing.T) (string, int, ssh.PublicKey) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testUsername && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	serverConfig.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, serverConfig)
+		}
+	}()
+	address := listener.Addr().(*net.TCPAddr)
+	return address.IP.String(), address.Port, signer.PublicKey()
+}
+
+func serve(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				// The payload of the subsystem request is the string "sftp".
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				_ = request.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				_ = server.Serve()
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+func newStorage(t *testing.T) *Storage {
+	host, port, _ := startServer(t)
+	return New(&Config{
+		Host:                  host,
+		Port:                  port,
+		Username:              testUsername,
+		Password:              testPassword,
+		RemotePath:            filepath.Join(t.TempDir(), "Backup"),
+		InsecureIgnoreHostKey: true,
+	})
+}
+
+func writeBackup(t *testing.T, size int) (string, []byte) {
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "db_2024-01-02T03-04-05.tar.lz4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return src, content
+}
+
+func assertUploaded(t *testing.T, storage *Storage, src string, content []byte) {
+	uploaded, err := os.ReadFile(filepath.Join(storage.config.RemotePath, filepath.Base(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Fatal("uploaded backup differs from the local one")
+	}
+	for _, extension := range []string{partExtension, sourceExtension} {
+		if _, err := os.Stat(filepath.Join(storage.config.RemotePath, filepath.Base(src)+extension)); !os.IsNotExist(err) {
+			t.Fatalf("%s file is left after the upload: %v", extension, err)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	storage := newStorage(t)
+	src, content := writeBackup(t, 1<<20+123)
+	if err := storage.Upload(src); err != nil {
+		t.Fatal(err)
+	}
+	assertUploaded(t, storage, src, content)
+	// The second upload replaces the existing backup.
+	if err := os.WriteFile(src, content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(src); err != nil {
+		t.Fatal(err)
+	}
+	assertUploaded(t, storage, src, content[:1000])
+}
+
+// TestUploadResume starts from a part of zeros, so only a continued upload
+// keeps them in the backup.
+func TestUploadResume(t *testing.T) {
+	sameSource := func(content []byte) string {
+		return fmt.Sprintf("%d %x", len(content), sha256.Sum256(content))
+	}
+	tests := []struct {
+		name     string
+		resume   bool
+		part     func(content []byte) []byte
+		source   func(content []byte) string
+		expected func(content []byte) []byte
+	}{
+		{
+			name:   "continue a part of the same source",
+			resume: true,
+			part:   func(content []byte) []byte { return make([]byte, 300000) },
+			source: sameSource,
+			expected: func(content []byte) []byte {
+				return append(make([]byte, 300000), content[300000:]...)
+			},
+		},
+		{
+			name:     "complete part",
+			resume:   true,
+			part:     func(content []byte) []byte { return content },
+			source:   sameSource,
+			expected: func(content []byte) []byte { return content },
+		},
+		{
+			name:     "restart without resume",
+			part:     func(content []byte) []byte { return make([]byte, 300000) },
+			source:   sameSource,
+			expected: func(content []byte) []byte { return content },
+		},
+		{
+			name:     "restart a part of another source",
+			resume:   true,
+			part:     func(content []byte) []byte { return make([]byte, 300000) },
+			source:   func(content []byte) string { return fmt.Sprintf("%d %x", len(content), sha256.Sum256(nil)) },
+			expected: func(content []byte) []byte { return content },
+		},
+		{
+			name:     "restart a part without source",
+			resume:   true,
+			part:     func(content []byte) []byte { return make([]byte, 300000) },
+			expected: func(content []byte) []byte { return content },
+		},
+		{
+			name:   "restart a part larger than the backup",
+			resume: true,
+			part: func(content []byte) []byte {
+				return append(append([]byte{}, content...), content[:10]...)
+			},
+			source:   sameSource,
+			expected: func(content []byte) []byte { return content },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newStorage(t)
+			storage.SetResume(test.resume)
+			src, content := writeBackup(t, 700000)
+			if err := os.MkdirAll(storage.config.RemotePath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			dstPath := filepath.Join(storage.config.RemotePath, filepath.Base(src))
+			if err := os.WriteFile(dstPath+partExtension, test.part(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.source != nil {
+				if err := os.WriteFile(dstPath+sourceExtension, []byte(test.source(content)), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := storage.Upload(src); err != nil {
+				t.Fatal(err)
+			}
+			assertUploaded(t, storage, src, test.expected(content))
+		})
+	}
+}
+
+func TestUploadStreamListDownloadDelete(t *testing.T) {
+	storage := newStorage(t)
+	_, content := writeBackup(t, 500000)
+	if err := storage.UploadStream("db_1.tar.lz4", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(storage.config.RemotePath, "db_2.tar.lz4"+partExtension), []byte("part"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(storage.config.RemotePath, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "db_1.tar.lz4" || backups[0].Size != int64(len(content)) {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	destination := filepath.Join(t.TempDir(), "db_1.tar.lz4")
+	if err := storage.Download(destination, "db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if downloaded, _ := os.ReadFile(destination); !bytes.Equal(downloaded, content) {
+		t.Fatal("downloaded backup differs from the uploaded one")
+	}
+	reader, err := storage.DownloadStream("db_1.tar.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed, content) {
+		t.Fatal("streamed backup differs from the uploaded one")
+	}
+	if err := storage.Delete("db_1.tar.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storage.config.RemotePath, "db_1.tar.lz4")); !os.IsNotExist(err) {
+		t.Fatalf("backup is not deleted: %v", err)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	host, port, hostKey := startServer(t)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		key     ssh.PublicKey
+		success bool
+	}{
+		{name: "known host key", key: hostKey, success: true},
+		{name: "changed host key", key: otherSigner.PublicKey()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+			line := knownhosts.Line([]string{net.JoinHostPort(host, strconv.Itoa(port))}, test.key)
+			if err := os.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			storage := New(&Config{
+				Host:           host,
+				Port:           port,
+				Username:       testUsername,
+				Password:       testPassword,
+				RemotePath:     t.TempDir(),
+				KnownHostsPath: knownHostsPath,
+			})
+			if _, err := storage.List(); (err == nil) != test.success {
+				t.Fatalf("unexpected result of the host key check: %v", err)
+			}
+		})
+	}
+}
@@ -2,29 +2,141 @@ package storage
 
 import (
 	"clickhouse-tools/internal/service/config"
+	"clickhouse-tools/internal/service/storage/azblob"
+	"clickhouse-tools/internal/service/storage/gcs"
+	"clickhouse-tools/internal/service/storage/local"
 	"clickhouse-tools/internal/service/storage/rsync"
 	"clickhouse-tools/internal/service/storage/s3"
+	"clickhouse-tools/internal/service/storage/sftp"
+	"clickhouse-tools/internal/service/storage/types"
 	"clickhouse-tools/pkg/encryptor"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"path"
 )
 
+type BackupInfo = types.BackupInfo
+
 type Interface interface {
 	Upload(src string) error
-	GetBackupListString() (string, error)
+	List() ([]BackupInfo, error)
 	Download(destination, backupName string) error
+	Delete(backupName string) error
+}
+
+// Resumable is implemented by storages able to continue an interrupted
+// upload or download instead of starting it from scratch.
+type Resumable interface {
+	SetResume(resume bool)
+}
+
+// Streamer is implemented by storages able to transfer a backup without a
+// local copy of the whole archive.
+type Streamer interface {
+	UploadStream(backupName string, reader io.Reader, size int64) error
+	DownloadStream(backupName string) (io.ReadCloser, error)
+}
+
+// MultipartInterface is implemented by storages keeping unfinished multipart
+// uploads that have to be aborted explicitly.
+type MultipartInterface interface {
+	ListMultipartUploads() ([]types.MultipartUpload, error)
+	AbortMultipartUpload(upload types.MultipartUpload) error
+}
+
+// Throttled is implemented by storages able to limit their transfer rate,
+// in bytes per second.
+type Throttled interface {
+	SetRateLimit(upload, download int64)
+}
+
+// Checksummed is implemented by storages keeping the SHA-256 of the plain
+// archive as metadata of the backup. SetChecksum sets it for the next upload
+// of an encrypted file or a stream, plain files are hashed by the storage
+// itself.
+type Checksummed interface {
+	SetChecksum(checksum string)
+	Checksum(backupName string) (string, error)
 }
 
+// Unwrap returns the underlying storage of a decorated one.
+func Unwrap(storage Interface) Interface {
+	if wrapper, ok := storage.(interface{ Unwrap() Interface }); ok {
+		return Unwrap(wrapper.Unwrap())
+	}
+	return storage
+}
+
+// InitStorage creates the storage of a named profile or, when no profile has
+// this name, the default storage of the type with this name.
 func InitStorage(conf *config.Application, storageName string) (Interface, error) {
-	switch storageName {
+	profile, ok := conf.Storages[storageName]
+	if !ok {
+		profile = conf.DefaultStorageProfile(storageName)
+	}
+	var storage Interface
+	switch profile.Type {
 	case rsync.Name:
-		return rsync.New(conf.Rsync), nil
+		storage = rsync.New(profile.Rsync)
 	case s3.Name:
-		enc := encryptor.New(conf.Encryption)
-		return s3.New(conf.S3, enc), nil
+		s3Storage := s3.New(profile.S3)
+		s3Storage.SetProfile(profile.Name)
+		storage = s3Storage
+	case gcs.Name:
+		storage = gcs.New(profile.GCS)
+	case azblob.Name:
+		storage = azblob.New(profile.AzBlob)
+	case sftp.Name:
+		storage = sftp.New(profile.Sftp)
+	case local.Name:
+		storage = local.New(profile.Local)
 	default:
 		err := fmt.Errorf("unsupported storage name '%s'", storageName)
+		if ok {
+			err = fmt.Errorf("unsupported type '%s' of storage '%s'", profile.Type, storageName)
+		}
 		log.Errorf("%+v", err)
 		return nil, err
 	}
+	if throttled, ok := storage.(Throttled); ok {
+		throttled.SetRateLimit(conf.Throttle.UploadLimit, conf.Throttle.DownloadLimit)
+	}
+	if conf.Encryption.SecretKey == "" {
+		// S3 uploads have always been encrypted, they aren't downgraded to
+		// plain backups unless that is allowed explicitly.
+		if profile.Type == s3.Name && !conf.Encryption.AllowPlaintext {
+			err := fmt.Errorf("storage '%s' requires ENCRYPTION_SECRET_KEY, set ENCRYPTION_ALLOW_PLAINTEXT=1 to store plain backups", storageName)
+			log.Errorf("%+v", err)
+			return nil, err
+		}
+		if profile.Type == s3.Name {
+			log.Warnf("ENCRYPTION_SECRET_KEY is not set, backups in storage '%s' are NOT encrypted", storageName)
+		}
+		return storage, nil
+	}
+	return NewEncrypted(storage, encryptor.New(conf.Encryption)), nil
+}
+
+// Describe returns a short human-readable location of the profile's target.
+func Describe(profile *config.StorageProfile) string {
+	switch profile.Type {
+	case rsync.Name:
+		return fmt.Sprintf("%s:%s", profile.Rsync.Host, profile.Rsync.RemotePath)
+	case s3.Name:
+		location := path.Join(profile.S3.Bucket, profile.S3.Directory)
+		if profile.S3.Endpoint != "" {
+			return fmt.Sprintf("s3://%s (%s)", location, profile.S3.Endpoint)
+		}
+		return fmt.Sprintf("s3://%s (%s)", location, profile.S3.Region)
+	case gcs.Name:
+		return "gs://" + path.Join(profile.GCS.Bucket, profile.GCS.Directory)
+	case azblob.Name:
+		return fmt.Sprintf("%s/%s", profile.AzBlob.AccountName, path.Join(profile.AzBlob.Container, profile.AzBlob.Prefix))
+	case sftp.Name:
+		return fmt.Sprintf("%s@%s:%d%s", profile.Sftp.Username, profile.Sftp.Host, profile.Sftp.Port, profile.Sftp.RemotePath)
+	case local.Name:
+		return profile.Local.Path
+	}
+	return ""
 }
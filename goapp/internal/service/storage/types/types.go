@@ -0,0 +1,95 @@
+package types
+
+import (
+	"clickhouse-tools/internal/helper"
+	"clickhouse-tools/pkg/encryptor"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// ChecksumKey is the metadata key of the SHA-256 of the plain archive.
+	ChecksumKey = "sha256"
+)
+
+var ErrObjectLocked = errors.New("backup is protected by object lock")
+
+var volumeRegExp = regexp.MustCompile(`^(.+)\.(\d{3,})$`)
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modified_at"`
+	Encrypted bool      `json:"encrypted"`
+	Volumes   int       `json:"volumes"`
+	// MD5 is the hex checksum of the backup when the storage reports it.
+	MD5 string `json:"md5,omitempty"`
+}
+
+func NewBackupInfo(name string, size int64, modTime time.Time) BackupInfo {
+	return BackupInfo{
+		Name:      name,
+		Size:      size,
+		ModTime:   modTime,
+		Encrypted: strings.HasSuffix(name, encryptor.Extension),
+		Volumes:   1,
+	}
+}
+
+// GroupVolumes merges split archives named "<backup>.001", "<backup>.002", ...
+// into a single entry with the summed size and the latest modification time.
+func GroupVolumes(backupList []BackupInfo) []BackupInfo {
+	var grouped []BackupInfo
+	indexes := map[string]int{}
+	for _, backup := range backupList {
+		name := backup.Name
+		if match := volumeRegExp.FindStringSubmatch(backup.Name); match != nil {
+			name = match[1]
+			backup.MD5 = ""
+		}
+		index, ok := indexes[name]
+		if !ok {
+			indexes[name] = len(grouped)
+			backup.Name = name
+			backup.Encrypted = backup.Encrypted || strings.HasSuffix(name, encryptor.Extension)
+			grouped = append(grouped, backup)
+			continue
+		}
+		grouped[index].Size += backup.Size
+		grouped[index].Volumes += backup.Volumes
+		if backup.ModTime.After(grouped[index].ModTime) {
+			grouped[index].ModTime = backup.ModTime
+		}
+	}
+	return grouped
+}
+
+// BelongsTo reports whether an object named relative to the storage directory
+// is a part of the backup: the archive itself, one of its volumes or an object
+// of its sub-directory.
+func BelongsTo(objectName, backupName string) bool {
+	if objectName == backupName || strings.HasPrefix(objectName, backupName+"/") {
+		return true
+	}
+	match := volumeRegExp.FindStringSubmatch(objectName)
+	return match != nil && match[1] == backupName
+}
+
+// UploadChecksum returns the checksum set for the upload or the SHA-256 of
+// src when it is a plain archive. Encrypted files get none, restore compares
+// the checksum with the decrypted local copy.
+func UploadChecksum(src, checksum string) (string, error) {
+	if checksum != "" || strings.HasSuffix(src, encryptor.Extension) {
+		return checksum, nil
+	}
+	return helper.FileSHA256(src)
+}
+
+// MultipartUpload describes an unfinished multipart upload left on a storage.
+type MultipartUpload struct {
+	Key       string    `json:"key"`
+	UploadId  string    `json:"upload_id"`
+	Initiated time.Time `json:"initiated_at"`
+}
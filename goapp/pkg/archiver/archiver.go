@@ -1,10 +1,18 @@
 package archiver
 
 import (
+	"archive/tar"
+	"clickhouse-tools/pkg/progress"
+	"clickhouse-tools/pkg/throttle"
+	"errors"
 	"fmt"
 	archiverLibrary "github.com/mholt/archiver/v3"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -19,15 +27,18 @@ const (
 type Config struct {
 	CompressionFormat string
 	CompressionLevel  int
+	ReadLimit         int64
 }
 
 type Archiver struct {
-	Config *Config
+	Config  *Config
+	limiter *throttle.Limiter
 }
 
 type File struct {
 	Path, Name string
 	Info       os.FileInfo
+	Progress   *progress.Progress
 }
 
 type Stringed interface {
@@ -139,22 +150,119 @@ func (archiver *Archiver) AddFile(writer archiverLibrary.Writer, addingFile *Fil
 			FileInfo:   addingFile.Info,
 			CustomName: addingFile.Name,
 		},
-		ReadCloser: file,
+		ReadCloser: addingFile.Progress.ReadCloser(throttle.NewReadCloser(file, archiver.readLimiter())),
 	}); err != nil {
 		log.Errorf("%+v", err)
 		return err
 	}
+	addingFile.Progress.Done()
 	return nil
 }
 
+// readLimiter is created on the first use, after the command has applied
+// its --read-limit, and is shared by all files of the archive.
+func (archiver *Archiver) readLimiter() *throttle.Limiter {
+	if archiver.limiter == nil {
+		archiver.limiter = throttle.New(archiver.Config.ReadLimit)
+	}
+	return archiver.limiter
+}
+
+// Unarchive extracts the archive file through UnarchiveStream to report the
+// extract progress by the bytes read.
 func (archiver *Archiver) Unarchive(srcPath, dstPath string) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(file)
+	fileStat, err := file.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	extractProgress := progress.Start("extract", fileStat.Size())
+	defer extractProgress.Finish()
+	return archiver.UnarchiveStream(extractProgress.Reader(file), path.Base(srcPath), dstPath)
+}
+
+// UnarchiveStream extracts an archive read from a stream, so it never has to
+// be stored on disk. The format is chosen by the archive name.
+func (archiver *Archiver) UnarchiveStream(reader io.Reader, archiveName, dstPath string) error {
 	if err := os.RemoveAll(dstPath); err != nil {
 		log.Errorf("%+v", err)
 		return err
 	}
-	if err := archiverLibrary.Unarchive(srcPath, dstPath); err != nil {
+	format, err := archiverLibrary.ByExtension(archiveName)
+	if err != nil {
 		log.Errorf("%+v", err)
 		return err
 	}
-	return nil
+	archiveReader, ok := format.(archiverLibrary.Reader)
+	if !ok {
+		err := fmt.Errorf("format of '%s' can't be read from a stream", archiveName)
+		log.Errorf("%+v", err)
+		return err
+	}
+	if err := archiveReader.Open(reader, 0); err != nil {
+		log.Errorf("%+v", err)
+		return err
+	}
+	defer func(archiveReader archiverLibrary.Reader) {
+		if err := archiveReader.Close(); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}(archiveReader)
+	for {
+		file, err := archiveReader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+		err = extractFile(file, dstPath)
+		_ = file.Close()
+		if err != nil {
+			log.Errorf("%+v", err)
+			return err
+		}
+	}
+}
+
+func extractFile(file archiverLibrary.File, dstPath string) error {
+	header, ok := file.Header.(*tar.Header)
+	if !ok {
+		return fmt.Errorf("unexpected archive header %T", file.Header)
+	}
+	filePath := filepath.Join(dstPath, header.Name)
+	if !strings.HasPrefix(filePath, filepath.Clean(dstPath)+string(os.PathSeparator)) {
+		return fmt.Errorf("illegal file path '%s' in archive", header.Name)
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(filePath, 0755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, file); err != nil {
+			_ = out.Close()
+			return err
+		}
+		return out.Close()
+	case tar.TypeXGlobalHeader:
+		return nil
+	}
+	return fmt.Errorf("unsupported type of '%s' in archive", header.Name)
 }
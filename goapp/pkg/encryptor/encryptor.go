@@ -1,6 +1,7 @@
 package encryptor
 
 import (
+	"clickhouse-tools/pkg/progress"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -11,9 +12,19 @@ import (
 	"strings"
 )
 
+const (
+	Extension = ".enc"
+	// Overhead is the size of the IV and salt appended to encrypted data.
+	Overhead = aes.BlockSize + saltSize
+	saltSize = 32
+)
+
 type Config struct {
 	SecretKey  string
 	BufferSize int
+	// AllowPlaintext allows storages that always encrypted uploads to store
+	// plain backups when no secret key is set.
+	AllowPlaintext bool
 }
 
 type Encryptor struct {
@@ -27,7 +38,7 @@ func New(config *Config) *Encryptor {
 }
 
 func (encryptor *Encryptor) EncryptFile(src string) (string, error) {
-	encSrc := src + ".enc"
+	encSrc := src + Extension
 	srcFile, err := os.Open(src)
 	if err != nil {
 		log.Errorf("%+v", err)
@@ -68,14 +79,22 @@ func (encryptor *Encryptor) EncryptFile(src string) (string, error) {
 		}
 	}(dstFile)
 
+	srcFileStat, err := srcFile.Stat()
+	if err != nil {
+		log.Errorf("%+v", err)
+		return "", err
+	}
+	encryptProgress := progress.Start("encrypt", srcFileStat.Size())
+	defer encryptProgress.Finish()
 	buf := make([]byte, encryptor.Config.BufferSize)
 	stream := cipher.NewCTR(block, iv)
 	for {
 		n, err := srcFile.Read(buf)
 		if n > 0 {
+			encryptProgress.Add(int64(n))
 			stream.XORKeyStream(buf, buf[:n])
 			_, writeErr := dstFile.Write(buf[:n])
-			if err != nil {
+			if writeErr != nil {
 				log.Errorf("%+v", writeErr)
 				return "", writeErr
 			}
@@ -100,7 +119,7 @@ func (encryptor *Encryptor) EncryptFile(src string) (string, error) {
 }
 
 func (encryptor *Encryptor) DecryptFile(encSrc string) (string, error) {
-	dstSrc := strings.TrimRight(encSrc, ".enc")
+	dstSrc := strings.TrimSuffix(encSrc, Extension)
 	encFile, err := os.Open(encSrc)
 	if err != nil {
 		log.Errorf("%+v", err)
@@ -119,7 +138,7 @@ func (encryptor *Encryptor) DecryptFile(encSrc string) (string, error) {
 		return "", err
 	}
 
-	salt := make([]byte, 32)
+	salt := make([]byte, saltSize)
 	saltStart := encFileStat.Size() - int64(len(salt))
 	if _, err = encFile.ReadAt(salt, saltStart); err != nil {
 		log.Errorf("%+v", err)
@@ -155,6 +174,8 @@ func (encryptor *Encryptor) DecryptFile(encSrc string) (string, error) {
 		}
 	}(dstFile)
 
+	decryptProgress := progress.Start("decrypt", msgLen)
+	defer decryptProgress.Finish()
 	buf := make([]byte, encryptor.Config.BufferSize)
 	stream := cipher.NewCTR(block, iv)
 	for {
@@ -163,6 +184,7 @@ func (encryptor *Encryptor) DecryptFile(encSrc string) (string, error) {
 			if n > int(msgLen) {
 				n = int(msgLen)
 			}
+			decryptProgress.Add(int64(n))
 			msgLen -= int64(n)
 			stream.XORKeyStream(buf, buf[:n])
 			if _, err := dstFile.Write(buf[:n]); err != nil {
@@ -183,7 +205,7 @@ func (encryptor *Encryptor) DecryptFile(encSrc string) (string, error) {
 
 func (encryptor *Encryptor) deriveKey(keyStr, salt []byte) ([]byte, []byte, error) {
 	if salt == nil {
-		salt = make([]byte, 32)
+		salt = make([]byte, saltSize)
 		if _, err := rand.Read(salt); err != nil {
 			log.Errorf("%+v", err)
 			return nil, nil, err
@@ -0,0 +1,333 @@
+package progress
+
+import (
+	"clickhouse-tools/internal/helper"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UnitFiles   = "files"
+	UnitTables  = "tables"
+	UnitParts   = "parts"
+	UnitEntries = "entries"
+
+	barWidth      = 20
+	refreshPeriod = 500 * time.Millisecond
+)
+
+type Config struct {
+	Enabled     bool
+	LogInterval time.Duration
+}
+
+var (
+	config = &Config{
+		Enabled:     true,
+		LogInterval: 30 * time.Second,
+	}
+	// drawing is set while a bar is on the terminal; phases running at the
+	// same time, like uploads of the task command, are logged instead.
+	drawing atomic.Bool
+)
+
+// Configure replaces the settings used by every phase started afterwards.
+func Configure(conf *Config) {
+	config = conf
+}
+
+// Progress reports one phase of a command, e.g. "archive" or "upload". On a
+// terminal it draws a bar right after the phase message, otherwise it logs
+// the counters periodically. A nil Progress reports nothing.
+type Progress struct {
+	phase      string
+	total      int64
+	mu         sync.Mutex
+	unit       string
+	totalItems int64
+	bytes      atomic.Int64
+	items      atomic.Int64
+	started    time.Time
+	tty        bool
+	drawn      int
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+	finish     sync.Once
+}
+
+// Start begins reporting a phase; zero total means the size is unknown.
+func Start(phase string, total int64) *Progress {
+	if !config.Enabled {
+		return nil
+	}
+	p := &Progress{
+		phase:   phase,
+		unit:    UnitFiles,
+		total:   total,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+	}
+	p.tty = isTerminal() && drawing.CompareAndSwap(false, true)
+	period := config.LogInterval
+	if p.tty {
+		period = refreshPeriod
+	}
+	if period <= 0 {
+		return p
+	}
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.report()
+			}
+		}
+	}()
+	return p
+}
+
+// SetItems sets the number of files, tables or parts the phase processes.
+func (p *Progress) SetItems(total int, unit string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.totalItems = int64(total)
+	p.unit = unit
+}
+
+func (p *Progress) itemsTotal() (int64, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.totalItems, p.unit
+}
+
+func (p *Progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.bytes.Add(n)
+}
+
+// Done marks one file, table or part as processed.
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+	p.items.Add(1)
+}
+
+// Finish stops reporting and erases the bar, or logs the phase totals when
+// not on a terminal.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.finish.Do(func() {
+		close(p.stop)
+		p.stopped.Wait()
+		if p.tty {
+			p.erase()
+			drawing.Store(false)
+			return
+		}
+		elapsed := time.Since(p.started)
+		log.WithFields(p.fields(elapsed)).WithField("duration", elapsed.Round(time.Millisecond).String()).Infof("%s finished", p.phase)
+	})
+}
+
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &reader{Reader: r, progress: p}
+}
+
+func (p *Progress) ReadCloser(r io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return r
+	}
+	return &readCloser{reader: reader{Reader: r, progress: p}, Closer: r}
+}
+
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &writer{Writer: w, progress: p}
+}
+
+func (p *Progress) WriterAt(w io.WriterAt) io.WriterAt {
+	if p == nil {
+		return w
+	}
+	return &writerAt{WriterAt: w, progress: p}
+}
+
+// Transport counts request bodies, i.e. the bytes sent by an HTTP client
+// doing the transfer on its own, like the S3 uploader.
+func (p *Progress) Transport(base http.RoundTripper) http.RoundTripper {
+	if p == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base, progress: p}
+}
+
+func (p *Progress) report() {
+	elapsed := time.Since(p.started)
+	if !p.tty {
+		log.WithFields(p.fields(elapsed)).Infof("%s in progress", p.phase)
+		return
+	}
+	p.erase()
+	line := p.line(elapsed)
+	p.drawn = len(line)
+	fmt.Print(line)
+}
+
+// erase moves the cursor back to the end of the phase message.
+func (p *Progress) erase() {
+	if p.drawn > 0 {
+		fmt.Printf("\033[%dD\033[K", p.drawn)
+		p.drawn = 0
+	}
+}
+
+func (p *Progress) line(elapsed time.Duration) string {
+	var line strings.Builder
+	bytes, rate := p.bytes.Load(), p.rate(elapsed)
+	if p.total > 0 {
+		done := min(bytes, p.total)
+		filled := int(done * barWidth / p.total)
+		fmt.Fprintf(&line, " [%s%s] %3d%% %s/%s", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), done*100/p.total, helper.FormatBytes(done), helper.FormatBytes(p.total))
+	} else if bytes > 0 {
+		fmt.Fprintf(&line, " %s", helper.FormatBytes(bytes))
+	}
+	totalItems, unit := p.itemsTotal()
+	if totalItems > 0 {
+		fmt.Fprintf(&line, " %d/%d %s", p.items.Load(), totalItems, unit)
+	} else if items := p.items.Load(); items > 0 {
+		fmt.Fprintf(&line, " %d %s", items, unit)
+	}
+	if rate > 0 {
+		fmt.Fprintf(&line, " %s/s", helper.FormatBytes(int64(rate)))
+	}
+	if eta := p.eta(elapsed); eta > 0 {
+		fmt.Fprintf(&line, " ETA %s", eta.Round(time.Second))
+	}
+	return line.String()
+}
+
+func (p *Progress) fields(elapsed time.Duration) log.Fields {
+	totalItems, unit := p.itemsTotal()
+	fields := log.Fields{
+		"phase":      p.phase,
+		"bytes":      p.bytes.Load(),
+		"throughput": int64(p.rate(elapsed)),
+		unit:         p.items.Load(),
+	}
+	if p.total > 0 {
+		fields["bytes_total"] = p.total
+	}
+	if totalItems > 0 {
+		fields[unit+"_total"] = totalItems
+	}
+	if eta := p.eta(elapsed); eta > 0 {
+		fields["eta_seconds"] = int64(eta.Seconds())
+	}
+	return fields
+}
+
+// rate is the average throughput in bytes per second.
+func (p *Progress) rate(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.bytes.Load()) / elapsed.Seconds()
+}
+
+// eta is estimated by bytes when the size is known and by items otherwise.
+func (p *Progress) eta(elapsed time.Duration) time.Duration {
+	done, total := p.bytes.Load(), p.total
+	if total <= 0 {
+		done = p.items.Load()
+		total, _ = p.itemsTotal()
+	}
+	if done <= 0 || total <= 0 || done >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+}
+
+func isTerminal() bool {
+	stat, err := os.Stdout.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+type reader struct {
+	io.Reader
+	progress *Progress
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.Add(int64(n))
+	return n, err
+}
+
+type readCloser struct {
+	reader
+	io.Closer
+}
+
+type writer struct {
+	io.Writer
+	progress *Progress
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.progress.Add(int64(n))
+	return n, err
+}
+
+type writerAt struct {
+	io.WriterAt
+	progress *Progress
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.progress.Add(int64(n))
+	return n, err
+}
+
+type transport struct {
+	base     http.RoundTripper
+	progress *Progress
+}
+
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil && request.Body != http.NoBody {
+		request = request.Clone(request.Context())
+		request.Body = t.progress.ReadCloser(request.Body)
+	}
+	return t.base.RoundTrip(request)
+}
@@ -0,0 +1,44 @@
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// IOPriority is an I/O scheduling class with a level from 0 (highest) to 7,
+// the same as `ionice -c <class> -n <level>`.
+type IOPriority struct {
+	Class string
+	Level int
+}
+
+// ParseIOPriority parses "idle", "best-effort", "best-effort:7" or
+// "realtime:0". The level defaults to 4.
+func ParseIOPriority(value string) (*IOPriority, error) {
+	class, level, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(value)), ":")
+	priority := &IOPriority{Class: class, Level: 4}
+	switch class {
+	case IOClassRealtime, IOClassBestEffort:
+	case IOClassIdle:
+		if hasLevel {
+			return nil, fmt.Errorf("class '%s' has no level", IOClassIdle)
+		}
+		priority.Level = 0
+	default:
+		return nil, fmt.Errorf("wrong I/O class '%s', supported: '%s', '%s', '%s'", class, IOClassRealtime, IOClassBestEffort, IOClassIdle)
+	}
+	if hasLevel {
+		var err error
+		if priority.Level, err = strconv.Atoi(level); err != nil || priority.Level < 0 || priority.Level > 7 {
+			return nil, fmt.Errorf("wrong I/O level '%s', expected 0-7", level)
+		}
+	}
+	return priority, nil
+}
@@ -0,0 +1,56 @@
+package throttle
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	IOClassRealtime:   1,
+	IOClassBestEffort: 2,
+	IOClassIdle:       3,
+}
+
+// SetNice sets the CPU priority of the process, -20 (highest) to 19.
+func SetNice(nice int) error {
+	return forEachThread(func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// SetIOPriority sets the I/O scheduling class of the process. It only
+// affects schedulers supporting priorities, e.g. BFQ.
+func SetIOPriority(priority *IOPriority) error {
+	ioprio := ioprioClasses[priority.Class]<<ioprioClassShift | priority.Level
+	return forEachThread(func(tid int) error {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// forEachThread applies the priority to every thread, as Linux keeps both
+// priorities per thread, and threads and children started later inherit them.
+func forEachThread(apply func(tid int) error) error {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return apply(0)
+	}
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if err := apply(tid); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package throttle
+
+import (
+	"errors"
+)
+
+var errUnsupported = errors.New("process priority is supported only on linux")
+
+func SetNice(nice int) error {
+	return errUnsupported
+}
+
+func SetIOPriority(priority *IOPriority) error {
+	return errUnsupported
+}
@@ -0,0 +1,152 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by every reader it throttles, so parallel
+// transfers split the rate instead of multiplying it. A nil Limiter doesn't
+// limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns nil when bytesPerSecond is not positive.
+func New(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSecond) / 10
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred.
+func (limiter *Limiter) Wait(n int) {
+	if limiter == nil {
+		return
+	}
+	for n > 0 {
+		chunk := float64(n)
+		if chunk > limiter.burst {
+			chunk = limiter.burst
+		}
+		n -= int(chunk)
+		limiter.mu.Lock()
+		now := time.Now()
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+		limiter.last = now
+		limiter.tokens -= chunk
+		deficit := -limiter.tokens
+		limiter.mu.Unlock()
+		if deficit > 0 {
+			time.Sleep(time.Duration(deficit / limiter.rate * float64(time.Second)))
+		}
+	}
+}
+
+type reader struct {
+	io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > int(r.limiter.burst) {
+		p = p[:int(r.limiter.burst)]
+	}
+	n, err := r.Reader.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+type readCloser struct {
+	reader
+	io.Closer
+}
+
+// NewReader returns the reader itself when the limiter is nil.
+func NewReader(r io.Reader, limiter *Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &reader{Reader: r, limiter: limiter}
+}
+
+func NewReadCloser(r io.ReadCloser, limiter *Limiter) io.ReadCloser {
+	if limiter == nil {
+		return r
+	}
+	return &readCloser{reader: reader{Reader: r, limiter: limiter}, Closer: r}
+}
+
+// Transport throttles request bodies with Upload and response bodies with
+// Download, i.e. the bytes actually sent over the network.
+type Transport struct {
+	Base             http.RoundTripper
+	Upload, Download *Limiter
+}
+
+func (transport *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.Upload != nil && request.Body != nil && request.Body != http.NoBody {
+		request = request.Clone(request.Context())
+		request.Body = NewReadCloser(request.Body, transport.Upload)
+	}
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	response, err := base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	if transport.Download != nil && response.Body != nil {
+		response.Body = NewReadCloser(response.Body, transport.Download)
+	}
+	return response, nil
+}
+
+// ParseRate parses a rate in bytes per second with an optional binary
+// suffix: "512K", "10M", "1G". An empty string means no limit.
+func ParseRate(value string) (int64, error) {
+	rate := strings.ToUpper(strings.TrimSpace(value))
+	if rate == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(rate, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(rate, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(rate, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		rate = rate[:len(rate)-1]
+	}
+	number, err := strconv.ParseFloat(rate, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("wrong rate '%s', expected bytes per second like '512K', '10M' or '1G'", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}